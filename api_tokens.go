@@ -0,0 +1,194 @@
+package main
+
+import (
+	"html/template"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/0sm1les/gopherbb/auth"
+	"github.com/0sm1les/gopherbb/querydb"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	apiTokenPrefix = "gbb_"
+	maxAPITokens   = 25
+)
+
+// apiScopes are the scopes a token can be given, in the order settings lists them
+var apiScopes = []struct {
+	Name        string
+	Description string
+}{
+	{"posts:write", "create, edit and delete posts"},
+	{"comments:write", "comment and delete comments"},
+	{"likes:write", "like posts"},
+	{"drafts:read", "read your drafts"},
+	{"notifications:read", "read your notifications"},
+}
+
+// tokenRoutes maps the routes a token may use to the scope it needs. Other
+// state changing routes are refused, other GETs are served as if logged out.
+var tokenRoutes = map[string]string{
+	"POST /editor/render":           "posts:write",
+	"POST /editor/save":             "posts:write",
+	"POST /editor/:id/save":         "posts:write",
+	"POST /editor/post":             "posts:write",
+	"POST /editor/:id/post":         "posts:write",
+	"DELETE /delete/post/:pid":      "posts:write",
+	"POST /reply/:pid":              "comments:write",
+	"POST /reply/:pid/comment/:cid": "comments:write",
+	"DELETE /delete/reply/:cid":     "comments:write",
+	"POST /edit/reply/:cid":         "comments:write",
+	"POST /like/:pid":               "likes:write",
+	"POST /like/:pid/comment/:cid":  "likes:write",
+	"GET /user/drafts":              "drafts:read",
+	"GET /user/notifications":       "notifications:read",
+}
+
+func validScope(scope string) bool {
+	for _, s := range apiScopes {
+		if s.Name == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// apiTokenAuth resolves the uid from an Authorization: Bearer header instead
+// of the session cookie. The request gets a session that is never saved.
+func apiTokenAuth(c *gin.Context) {
+	header := c.GetHeader("Authorization")
+	if header == "" {
+		c.Next()
+		return
+	}
+	raw, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || !strings.HasPrefix(raw, apiTokenPrefix) {
+		c.AbortWithStatusJSON(401, gin.H{"error": "expected a bearer token"})
+		return
+	}
+
+	token, err := querydb.GetAPIToken(auth.HashToken(strings.TrimSpace(raw)))
+	if err == querydb.ErrInvalidToken {
+		c.AbortWithStatusJSON(401, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		logger.Error().Err(err).Msg("")
+		c.AbortWithStatus(500)
+		return
+	}
+
+	session, _ := store.Get(c.Request, "session")
+	for key := range session.Values {
+		delete(session.Values, key)
+	}
+	session.Values["id"] = int32(-1)
+	session.Values["csrf"] = ""
+	session.Values["api_token"] = token.Id
+
+	scope, ok := tokenRoutes[c.Request.Method+" "+c.FullPath()]
+	if !ok {
+		if c.Request.Method == "GET" || c.Request.Method == "HEAD" {
+			c.Next()
+			return
+		}
+		c.AbortWithStatusJSON(403, gin.H{"error": "this route can not be used with an api token"})
+		return
+	}
+	allowed := false
+	for _, s := range token.Scopes {
+		if s == scope {
+			allowed = true
+		}
+	}
+	if !allowed {
+		c.AbortWithStatusJSON(403, gin.H{"error": "token is missing the " + scope + " scope"})
+		return
+	}
+
+	session.Values["id"] = token.Uid
+	if err := querydb.TouchAPIToken(token.Id); err != nil {
+		logger.Error().Err(err).Msg("")
+	}
+	c.Next()
+}
+
+func newAPIToken(uid int32, c *gin.Context) {
+	feedback := func(message string) {
+		html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": message})
+	}
+
+	name := strings.TrimSpace(c.PostForm("name"))
+	if name == "" || utf8.RuneCountInString(name) > 64 {
+		feedback("name must be between 1 and 64 characters")
+		return
+	}
+
+	scopes := c.PostFormArray("scope")
+	if len(scopes) == 0 {
+		feedback("pick at least one scope")
+		return
+	}
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			feedback("invalid scope")
+			return
+		}
+	}
+
+	days, err := strconv.ParseInt(c.PostForm("days"), 10, 32)
+	if err != nil || days < 0 || days > 365 {
+		feedback("invalid expiry")
+		return
+	}
+
+	tokens, err := querydb.UserAPITokens(uid)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	if len(tokens) >= maxAPITokens {
+		feedback("revoke a token before creating another")
+		return
+	}
+
+	token, err := auth.NewToken()
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	token = apiTokenPrefix + token
+
+	lifetime := time.Duration(days) * 24 * time.Hour
+	if err := querydb.NewAPIToken(uid, name, auth.HashToken(token), scopes, int64(lifetime.Seconds())); err != nil {
+		logger.Error().Err(err).Msg("")
+		feedback("error creating token")
+		return
+	}
+
+	html := template.Must(newTemplate().ParseFiles("html/htmx/api_token.html"))
+	html.ExecuteTemplate(c.Writer, "html/htmx/api_token.html", gin.H{"Token": token})
+}
+
+func revokeAPIToken(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		token_id, err := strconv.ParseInt(c.Param("id"), 10, 32)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if err := querydb.DeleteAPIToken(uid, int32(token_id)); err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		c.Header("HX-Refresh", "true")
+	}
+}
@@ -1,8 +1,13 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"strings"
 	"unicode"
 
@@ -11,8 +16,16 @@ import (
 	"golang.org/x/crypto/argon2"
 )
 
+// salt is only used to verify hashes created before per-user salts existed
 var salt []byte
 
+var params = models.Argon2Params{Memory: 32 * 1024, Iterations: 3, Parallelism: 4}
+
+const (
+	saltLength = 16
+	keyLength  = 32
+)
+
 func ValidateUser(username string) (models.Username, error) {
 	username = strings.TrimSpace(username)
 	username = strings.ToLower(username)
@@ -42,11 +55,132 @@ func ValidatePassword(password string) (models.Password, error) {
 	return models.Password(password), nil
 }
 
+// SetSalt sets the global salt used by legacy hashes so they can still be
+// verified and upgraded on login.
 func SetSalt(salt_str string) {
 	salt = []byte(salt_str)
 }
 
-// supersecure
-func Hashpassword(password models.Password) models.Hash {
-	return models.Hash(hex.EncodeToString(argon2.Key([]byte(password), salt, 3, 32*1024, 4, 32)))
+// SetParams overrides the argon2id cost used for new hashes. Zero values keep the default.
+func SetParams(p models.Argon2Params) {
+	if p.Memory != 0 {
+		params.Memory = p.Memory
+	}
+	if p.Iterations != 0 {
+		params.Iterations = p.Iterations
+	}
+	if p.Parallelism != 0 {
+		params.Parallelism = p.Parallelism
+	}
+}
+
+// Hashpassword returns a PHC formatted argon2id hash with a random per-user salt:
+// $argon2id$v=19$m=32768,t=3,p=4$<salt>$<hash>
+func Hashpassword(password models.Password) (models.Hash, error) {
+	user_salt := make([]byte, saltLength)
+	if _, err := rand.Read(user_salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), user_salt, params.Iterations, params.Memory, params.Parallelism, keyLength)
+	return encodeHash(params, user_salt, key), nil
+}
+
+// ComparePassword reports whether password matches hash. Both PHC hashes and
+// legacy hex hashes made with the global salt are accepted.
+func ComparePassword(password models.Password, hash models.Hash) (bool, error) {
+	// accounts created through an identity provider have no password until they set one
+	if hash == "" {
+		return false, nil
+	}
+	if isLegacy(hash) {
+		if len(salt) == 0 {
+			return false, errors.New("legacy password hash found but no global salt is set")
+		}
+		legacy := hex.EncodeToString(argon2.Key([]byte(password), salt, 3, 32*1024, 4, 32))
+		return subtle.ConstantTimeCompare([]byte(legacy), []byte(hash)) == 1, nil
+	}
+
+	p, user_salt, key, err := decodeHash(hash)
+	if err != nil {
+		return false, err
+	}
+	computed := argon2.IDKey([]byte(password), user_salt, p.Iterations, p.Memory, p.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+// NeedsRehash reports whether hash is in the legacy format or was made with
+// different parameters than the ones currently configured.
+func NeedsRehash(hash models.Hash) bool {
+	if isLegacy(hash) {
+		return true
+	}
+	p, user_salt, key, err := decodeHash(hash)
+	if err != nil {
+		return true
+	}
+	return p != params || len(user_salt) != saltLength || len(key) != keyLength
+}
+
+func isLegacy(hash models.Hash) bool {
+	return !strings.HasPrefix(string(hash), "$")
+}
+
+func encodeHash(p models.Argon2Params, user_salt []byte, key []byte) models.Hash {
+	return models.Hash(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		p.Memory,
+		p.Iterations,
+		p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(user_salt),
+		base64.RawStdEncoding.EncodeToString(key)))
+}
+
+func decodeHash(hash models.Hash) (models.Argon2Params, []byte, []byte, error) {
+	var p models.Argon2Params
+	var version int
+
+	fields := strings.Split(string(hash), "$")
+	if len(fields) != 6 || fields[1] != "argon2id" {
+		return p, nil, nil, errors.New("unsupported password hash format")
+	}
+
+	if _, err := fmt.Sscanf(fields[2], "v=%d", &version); err != nil {
+		return p, nil, nil, err
+	}
+	if version != argon2.Version {
+		return p, nil, nil, errors.New("unsupported argon2 version")
+	}
+
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, err
+	}
+	if p.Memory == 0 || p.Iterations == 0 || p.Parallelism == 0 {
+		return p, nil, nil, errors.New("invalid argon2 parameters")
+	}
+
+	user_salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return p, nil, nil, err
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil {
+		return p, nil, nil, err
+	}
+	return p, user_salt, key, nil
+}
+
+// NewToken returns a random 256 bit hex token for sessions, links and other secrets
+func NewToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HashToken returns the sha256 hex digest stored in place of a token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"sort"
+	"strconv"
+
+	"github.com/0sm1les/gopherbb/models"
+	"github.com/0sm1les/gopherbb/querydb"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultCommentDepth = 6
+
+var commentSorts = []string{"oldest", "newest", "liked"}
+
+// commentThread is a comment with its replies as html/comment.html renders it
+type commentThread struct {
+	models.Comment
+	Replies []commentThread
+	// replies past the max depth, they are reached through "continue this thread"
+	More int
+	// shared by every comment on the page
+	Page *commentPage
+}
+
+// commentPage is what html/comment.html needs to know about the page it is on
+type commentPage struct {
+	Logged_in bool
+	Userinfo  models.User
+	Postinfo  models.Post
+	Sort      string
+}
+
+func validCommentSort(order string) bool {
+	for _, s := range commentSorts {
+		if s == order {
+			return true
+		}
+	}
+	return false
+}
+
+func setupComments(conf models.CommentConfig) error {
+	if conf.Sort != "" && !validCommentSort(conf.Sort) {
+		return fmt.Errorf("unknown comment sort %q", conf.Sort)
+	}
+	if conf.Max_depth < 0 {
+		return fmt.Errorf("max depth can't be negative")
+	}
+	return nil
+}
+
+func commentDepth() int {
+	if config.Comments.Max_depth == 0 {
+		return defaultCommentDepth
+	}
+	return config.Comments.Max_depth
+}
+
+// commentSort is the order asked for in the query, or the configured default
+func commentSort(c *gin.Context) string {
+	if order := c.Query("sort"); validCommentSort(order) {
+		return order
+	}
+	if config.Comments.Sort != "" {
+		return config.Comments.Sort
+	}
+	return "oldest"
+}
+
+func sortComments(comments []models.Comment, order string) {
+	sort.SliceStable(comments, func(i, j int) bool {
+		switch order {
+		case "newest":
+			return comments[i].Time_posted.After(comments[j].Time_posted)
+		case "liked":
+			return comments[i].Likes > comments[j].Likes
+		}
+		return comments[i].Time_posted.Before(comments[j].Time_posted)
+	})
+}
+
+// buildThreads nests comments under their parents starting at root, 0 for the whole
+// post. Comments whose parent was purged are shown at the top. Comments that aren't
+// posted stay as placeholders while they have replies so those aren't orphaned.
+func buildThreads(comments []models.Comment, root int32, order string, page *commentPage) []commentThread {
+	byId := map[int32]models.Comment{}
+	for _, comment := range comments {
+		byId[comment.Cid] = comment
+	}
+	children := map[int32][]models.Comment{}
+	for _, comment := range comments {
+		// a parent always comes before its replies, anything else can't be nested safely
+		var parent int32
+		if comment.Parent_comment != nil && *comment.Parent_comment < comment.Cid {
+			parent = *comment.Parent_comment
+		}
+		if _, ok := byId[parent]; !ok {
+			parent = 0
+		}
+		children[parent] = append(children[parent], comment)
+	}
+
+	var posted func(cid int32) int
+	posted = func(cid int32) int {
+		count := 0
+		for _, reply := range children[cid] {
+			if reply.Status == "posted" {
+				count++
+			}
+			count += posted(reply.Cid)
+		}
+		return count
+	}
+
+	maxDepth := commentDepth()
+	var build func(replies []models.Comment, depth int) []commentThread
+	build = func(replies []models.Comment, depth int) []commentThread {
+		sortComments(replies, order)
+		var threads []commentThread
+		for _, reply := range replies {
+			thread := commentThread{Comment: reply, Page: page}
+			if depth < maxDepth {
+				thread.Replies = build(children[reply.Cid], depth+1)
+			} else {
+				thread.More = posted(reply.Cid)
+			}
+			if reply.Status != "posted" && len(thread.Replies) == 0 && thread.More == 0 {
+				continue
+			}
+			threads = append(threads, thread)
+		}
+		return threads
+	}
+
+	if root == 0 {
+		return build(children[0], 1)
+	}
+	if comment, ok := byId[root]; ok {
+		return build([]models.Comment{comment}, 1)
+	}
+	return nil
+}
+
+// likeComment toggles the user's like on a comment and answers with the new button label
+func likeComment(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		pid, err := strconv.ParseInt(c.Param("pid"), 10, 32)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		cid, err := strconv.ParseInt(c.Param("cid"), 10, 32)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		_, section, _, err := querydb.GetPostOP(int32(pid))
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if !canReadPost(section, viewer(uid)) {
+			c.AbortWithStatus(404)
+			return
+		}
+		found, err := querydb.CommentOnPost(int32(cid), int32(pid))
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if !found {
+			c.AbortWithStatus(404)
+			return
+		}
+		if restriction, err := writeRestriction(uid); err != nil || restriction != "" {
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+			c.JSON(403, gin.H{"error": restriction})
+			return
+		}
+		liked, count, err := querydb.LikeUnlikeComment(uid, int32(cid))
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if liked {
+			c.String(200, "unlike (%d)", count)
+		} else {
+			c.String(200, "like (%d)", count)
+		}
+	}
+}
+
+// editReply shows the edit form for a comment and saves the edit
+func editReply(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		feedback := func(message string) {
+			html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+			html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": message})
+		}
+
+		cid, err := strconv.ParseInt(c.Param("cid"), 10, 32)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		userinfo, err := querydb.Userinfo(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		current, err := querydb.GetComment(int32(cid))
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if !canModify(userinfo, current.User_id, capCommentEditOwn, capCommentEditAny) {
+			logger.Warn().Str("username", string(userinfo.Username)).Msg("user tried to access unauthorized resource")
+			c.AbortWithStatus(403)
+			return
+		}
+		postinfo, err := querydb.GetPost(current.Parent_post)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if !canReadPost(postinfo.Section, &userinfo) {
+			c.AbortWithStatus(404)
+			return
+		}
+		if current.Status != "posted" {
+			feedback("this comment can't be edited anymore")
+			return
+		}
+		if postinfo.Locked && !can(userinfo.Role, capCommentEditAny) {
+			feedback("this thread is locked")
+			return
+		}
+
+		if c.Request.Method == "GET" {
+			html := template.Must(newTemplate().ParseFiles("html/htmx/edit_reply.html"))
+			html.ExecuteTemplate(c.Writer, "html/htmx/edit_reply.html", gin.H{"Cid": current.Cid, "Md": current.Md})
+			return
+		}
+
+		comment := c.PostForm("comment")
+		if len(comment) < 10 {
+			feedback("comment is too short")
+			return
+		}
+		if restriction, err := writeRestriction(uid); err != nil || restriction != "" {
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+			feedback(restriction)
+			return
+		}
+		if linksRefused(userinfo, comment) {
+			feedback("new accounts can't post links")
+			return
+		}
+		comment, refused := applyPolicy(comment)
+		if refused != "" {
+			feedback(refused)
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := md.Convert([]byte(comment), &buf); err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		edited, err := querydb.EditReply(current.Cid, uid, comment, buf.String(), modAction(uid, current.User_id, "comment.edit", "comment", current.Cid, ""))
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if !edited {
+			feedback("this comment can't be edited anymore")
+			return
+		}
+		c.Header("HX-Refresh", "true")
+	}
+}
+
+// commentHistory lists every version of an edited comment for staff
+func commentHistory(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		cid, err := strconv.ParseInt(c.Param("cid"), 10, 32)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		revisions, err := querydb.CommentRevisions(int32(cid))
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		for i := 0; i < len(revisions); i++ {
+			revisions[i].User, err = querydb.GetUser(revisions[i].Editor)
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+		}
+		html := template.Must(newTemplate().ParseFiles("html/htmx/comment_history.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/comment_history.html", gin.H{"Revisions": revisions})
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"html/template"
+	"strconv"
+	"strings"
+
+	"github.com/0sm1les/gopherbb/auth"
+	"github.com/0sm1les/gopherbb/models"
+	"github.com/0sm1les/gopherbb/querydb"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	dashboardUsers   = 20
+	dashboardContent = 30
+	userSearchSize   = 50
+)
+
+// dashboard is the staff overview of what is happening on the site
+func dashboard(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		userinfo, err := querydb.Userinfo(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		stats, err := querydb.SiteStats()
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		users, err := querydb.RecentUsers(dashboardUsers)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		content, err := querydb.RecentContent(dashboardContent)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		for i := 0; i < len(content); i++ {
+			content[i].Author, err = querydb.GetUser(content[i].Poster)
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+		}
+		reported, err := querydb.OpenReports()
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		sanctions, err := querydb.ActiveSanctions()
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+
+		html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/dashboard.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "dashboard", "Userinfo": userinfo, "Csrf": csrfToken(c)})
+		html.ExecuteTemplate(c.Writer, "html/dashboard.html", gin.H{"Userinfo": userinfo,
+			"Stats":     stats,
+			"Users":     users,
+			"Content":   content,
+			"Reported":  reported,
+			"Sanctions": sanctions})
+		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
+	}
+}
+
+// assignableRoles are the roles userinfo can give to users below them
+func assignableRoles(userinfo models.User) []string {
+	return roleOrder[:roleRank(userinfo.Role)+1]
+}
+
+// searchUsers lists users matching the q query for the dashboard
+func searchUsers(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		query := strings.TrimSpace(c.Query("q"))
+		if query == "" {
+			return
+		}
+		userinfo, err := querydb.Userinfo(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		users, err := querydb.SearchUsers(query, userSearchSize)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+
+		html := template.Must(newTemplate().ParseFiles("html/htmx/user_search.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/user_search.html", gin.H{"Users": users,
+			"Userinfo": userinfo,
+			"Roles":    assignableRoles(userinfo)})
+	}
+}
+
+// setUserRole changes the role of a user ranked below the staff member, to at most their own role
+func setUserRole(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		feedback := func(result string, message string) {
+			html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+			html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": result, "Message": message})
+		}
+
+		userinfo, err := querydb.Userinfo(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		user, err := auth.ValidateUser(c.Param("user"))
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		other_uid := querydb.UserExists(user)
+		if other_uid == -1 {
+			return
+		}
+		other_userinfo, err := querydb.Userinfo(other_uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+
+		role := c.PostForm("role")
+		rank := roleRank(role)
+		if rank == -1 {
+			feedback("error", "unknown role")
+			return
+		}
+		if other_uid == uid || roleRank(other_userinfo.Role) >= roleRank(userinfo.Role) || rank > roleRank(userinfo.Role) {
+			feedback("error", "you can only change the role of users below you, to at most your own role")
+			return
+		}
+
+		audit := &models.ModAction{Actor: uid, Action: "user.role", Target_type: "user", Target_id: other_uid, Reason: modReason(c)}
+		if _, err := querydb.SetRole(other_uid, role, audit); err != nil {
+			logger.Error().Err(err).Msg("")
+			feedback("error", "error changing role")
+			return
+		}
+		logger.Info().Str("role", role).Str("username", string(user)).Int32("by", uid).Msg("changed role")
+		feedback("ok", string(user)+" is now "+role)
+	}
+}
+
+// restoreContent puts back a deleted post or comment
+func restoreContent(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 32)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+
+		switch c.Param("target") {
+		case "post":
+			post, err := querydb.GetPost(int32(id))
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+			_, err = querydb.RestorePost(post.Pid, &models.ModAction{Actor: uid, Action: "post.restore", Target_type: "post", Target_id: post.Pid, Reason: modReason(c)})
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+		case "comment":
+			if _, err := querydb.GetCommentPoster(int32(id)); err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+			_, err = querydb.RestoreReply(int32(id), &models.ModAction{Actor: uid, Action: "comment.restore", Target_type: "comment", Target_id: int32(id), Reason: modReason(c)})
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+		default:
+			return
+		}
+		c.Header("HX-Refresh", "true")
+	}
+}
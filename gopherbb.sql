@@ -5,7 +5,7 @@ CREATE TABLE users (
     role varchar(12) CHECK (role in ('unranked', 'ranked', 'mod', 'admin')) DEFAULT 'unranked' NOT NULL,
     profile_pic varchar(255) DEFAULT 'default.png' NOT NULL,
     username varchar(16) NOT NULL,
-    password varchar(65) NOT NULL,
+    password varchar(255) NOT NULL,
     bio varchar(255) DEFAULT '' NOT NULL,
     user_fg_color varchar(6) DEFAULT '000000' NOT NULL,
     user_bg_color varchar(6) DEFAULT '000000' NOT NULL,
@@ -13,26 +13,33 @@ CREATE TABLE users (
     custom_secondary_text_color varchar(6) DEFAULT '000000' NOT NULL,
     custom_background_color varchar(6) DEFAULT 'ffffff' NOT NULL,
     custom_border_color varchar(6) DEFAULT '000000' NOT NULL,
-    date_joined timestamp without time zone NOT NULL
-);
-
-CREATE TABLE notifications (
-    id SERIAL PRIMARY KEY NOT NULL,
-    to_uid int references users(id) NOT NULL,
-    from_uid int references users(id) NOT NULL,
-    read boolean DEFAULT false NOT NULL,
-    msg varchar(255) NOT NULL
+    date_joined timestamp without time zone NOT NULL,
+    totp_secret varchar(32) DEFAULT '' NOT NULL,
+    totp_enabled boolean DEFAULT false NOT NULL,
+    totp_last_step bigint DEFAULT 0 NOT NULL,
+    status varchar(8) CHECK (status in ('active', 'pending', 'rejected')) DEFAULT 'active' NOT NULL,
+    invited_by int references users(id),
+    email varchar(255) DEFAULT '' NOT NULL,
+    email_verified boolean DEFAULT false NOT NULL,
+    email_digest boolean DEFAULT false NOT NULL,
+    digest_nid int DEFAULT 0 NOT NULL
 );
 
 CREATE TABLE posts (
     id SERIAL PRIMARY KEY NOT NULL,
     poster int references users(id) NOT NULL,
     section varchar(32) NOT NULL,
-    status varchar(8) CHECK (status in ('draft', 'posted', 'deleted')) NOT NULL,
+    status varchar(8) CHECK (status in ('draft', 'queued', 'posted', 'hidden', 'deleted', 'purged')) NOT NULL,
     title varchar(64) NOT NULL,
     md TEXT NOT NULL,
     html TEXT NOT NULL,
     time_posted timestamp without time zone NOT NULL,
+    locked boolean NOT NULL DEFAULT false,
+    pinned boolean NOT NULL DEFAULT false,
+    deleted timestamp without time zone,
+    deleted_by int references users(id),
+    -- the status to restore a deleted post to
+    deleted_from varchar(8),
     ts tsvector GENERATED ALWAYS AS (
     setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
     setweight(to_tsvector('english', coalesce(md, '')), 'B')
@@ -50,24 +57,208 @@ CREATE TABLE comments (
     id SERIAL PRIMARY KEY NOT NULL,
     poster int references users(id) NOT NULL,
     parent_post int references posts(id) NOT NULL,
-    parent_comment int,
-    status varchar(8) CHECK (status in ('posted', 'deleted')) DEFAULT 'posted' NOT NULL,
+    -- NULL for comments on the post itself, replies outlive a parent that is purged
+    parent_comment int references comments(id) ON DELETE SET NULL,
+    status varchar(8) CHECK (status in ('posted', 'hidden', 'deleted', 'purged')) DEFAULT 'posted' NOT NULL,
     md TEXT NOT NULL,
     html TEXT NOT NULL,
-    time_posted timestamp without time zone NOT NULL
+    time_posted timestamp without time zone NOT NULL,
+    deleted timestamp without time zone,
+    deleted_by int references users(id),
+    deleted_from varchar(8),
+    edited timestamp without time zone
+);
+
+-- every version of an edited comment including the current one, the first is the original
+CREATE TABLE comment_revisions (
+    id SERIAL PRIMARY KEY NOT NULL,
+    comment int references comments(id) ON DELETE CASCADE NOT NULL,
+    editor int references users(id) NOT NULL,
+    md TEXT NOT NULL,
+    html TEXT NOT NULL,
+    created timestamp without time zone NOT NULL
+);
+
+CREATE TABLE comment_likes (
+    id SERIAL PRIMARY KEY NOT NULL,
+    comment int references comments(id) NOT NULL,
+    liked_by int references users(id) NOT NULL,
+    time_liked timestamp without time zone NOT NULL,
+    UNIQUE (comment, liked_by)
+);
+
+CREATE TABLE notifications (
+    id SERIAL PRIMARY KEY NOT NULL,
+    to_uid int references users(id) NOT NULL,
+    from_uid int references users(id) NOT NULL,
+    read boolean DEFAULT false NOT NULL,
+    msg varchar(255) NOT NULL,
+    -- the post or comment the notification is about, purged with it
+    post int references posts(id),
+    comment int references comments(id)
+);
+
+CREATE TABLE sessions (
+    id SERIAL PRIMARY KEY NOT NULL,
+    uid int references users(id) NOT NULL,
+    token varchar(64) UNIQUE NOT NULL,
+    ip varchar(45) NOT NULL,
+    user_agent varchar(255) NOT NULL,
+    created timestamp without time zone NOT NULL,
+    last_seen timestamp without time zone NOT NULL
+);
+
+CREATE TABLE recovery_codes (
+    id SERIAL PRIMARY KEY NOT NULL,
+    uid int references users(id) NOT NULL,
+    code varchar(64) NOT NULL,
+    used boolean DEFAULT false NOT NULL
 );
 
+CREATE TABLE invites (
+    id SERIAL PRIMARY KEY NOT NULL,
+    code varchar(64) UNIQUE NOT NULL,
+    created_by int references users(id) NOT NULL,
+    max_uses int NOT NULL,
+    uses int DEFAULT 0 NOT NULL,
+    created timestamp without time zone NOT NULL,
+    expires timestamp without time zone NOT NULL
+);
+
+CREATE TABLE password_resets (
+    id SERIAL PRIMARY KEY NOT NULL,
+    uid int references users(id) NOT NULL,
+    token varchar(64) UNIQUE NOT NULL,
+    created_by int references users(id) NOT NULL,
+    used boolean DEFAULT false NOT NULL,
+    created timestamp without time zone NOT NULL,
+    expires timestamp without time zone NOT NULL
+);
+
+CREATE TABLE email_verifications (
+    id SERIAL PRIMARY KEY NOT NULL,
+    uid int references users(id) NOT NULL,
+    email varchar(255) NOT NULL,
+    token varchar(64) UNIQUE NOT NULL,
+    used boolean DEFAULT false NOT NULL,
+    expires timestamp without time zone NOT NULL
+);
+
+CREATE TABLE login_failures (
+    id SERIAL PRIMARY KEY NOT NULL,
+    key varchar(64) NOT NULL,
+    time_failed timestamp without time zone NOT NULL
+);
+
+CREATE TABLE login_locks (
+    key varchar(64) PRIMARY KEY NOT NULL,
+    locked_until timestamp without time zone NOT NULL,
+    strikes int DEFAULT 0 NOT NULL
+);
+
+CREATE TABLE used_challenges (
+    challenge varchar(128) PRIMARY KEY NOT NULL,
+    expires timestamp without time zone NOT NULL
+);
+
+CREATE TABLE identities (
+    id SERIAL PRIMARY KEY NOT NULL,
+    uid int references users(id) NOT NULL,
+    provider varchar(32) NOT NULL,
+    subject varchar(255) NOT NULL,
+    linked timestamp without time zone NOT NULL,
+    UNIQUE (provider, subject),
+    UNIQUE (uid, provider)
+);
+
+CREATE TABLE api_tokens (
+    id SERIAL PRIMARY KEY NOT NULL,
+    uid int references users(id) NOT NULL,
+    name varchar(64) NOT NULL,
+    token varchar(64) UNIQUE NOT NULL,
+    scopes varchar(255) NOT NULL,
+    created timestamp without time zone NOT NULL,
+    last_used timestamp without time zone,
+    expires timestamp without time zone
+);
+
+CREATE TABLE sanctions (
+    id SERIAL PRIMARY KEY NOT NULL,
+    uid int references users(id) NOT NULL,
+    kind varchar(8) CHECK (kind in ('mute', 'suspend', 'ban')) NOT NULL,
+    reason varchar(255) NOT NULL,
+    created_by int references users(id) NOT NULL,
+    created timestamp without time zone NOT NULL,
+    expires timestamp without time zone,
+    lifted_by int references users(id),
+    lifted timestamp without time zone
+);
+
+CREATE TABLE mod_actions (
+    id SERIAL PRIMARY KEY NOT NULL,
+    actor int references users(id) NOT NULL,
+    action varchar(32) NOT NULL,
+    target_type varchar(8) CHECK (target_type in ('post', 'comment', 'user')) NOT NULL,
+    target_id int NOT NULL,
+    reason varchar(255) DEFAULT '' NOT NULL,
+    before jsonb,
+    after jsonb,
+    time timestamp without time zone NOT NULL
+);
+
+CREATE TABLE reports (
+    id SERIAL PRIMARY KEY NOT NULL,
+    reporter int references users(id) NOT NULL,
+    target_type varchar(8) CHECK (target_type in ('post', 'comment')) NOT NULL,
+    target_id int NOT NULL,
+    category varchar(16) CHECK (category in ('spam', 'abuse', 'off_topic', 'other')) NOT NULL,
+    note varchar(500) DEFAULT '' NOT NULL,
+    status varchar(9) CHECK (status in ('open', 'dismissed', 'actioned')) DEFAULT 'open' NOT NULL,
+    created timestamp without time zone NOT NULL,
+    resolved_by int references users(id),
+    resolved timestamp without time zone,
+    UNIQUE (reporter, target_type, target_id)
+);
 
 CREATE USER gopherbb_user WITH ENCRYPTED PASSWORD '<INSERT PASSWORD HERE>';
 
 GRANT SELECT, INSERT, UPDATE on users TO gopherbb_user;
 GRANT SELECT, INSERT, UPDATE, DELETE on likes TO gopherbb_user;
-GRANT SELECT, INSERT, UPDATE on notifications TO gopherbb_user;
-GRANT SELECT, INSERT, UPDATE on posts TO gopherbb_user;
-GRANT SELECT, INSERT, UPDATE on comments TO gopherbb_user;
+GRANT SELECT, INSERT, UPDATE, DELETE on notifications TO gopherbb_user;
+GRANT SELECT, INSERT, UPDATE, DELETE on posts TO gopherbb_user;
+GRANT SELECT, INSERT, UPDATE, DELETE on comments TO gopherbb_user;
+GRANT SELECT, INSERT, UPDATE, DELETE on comment_likes TO gopherbb_user;
+GRANT SELECT, INSERT, DELETE on comment_revisions TO gopherbb_user;
+GRANT SELECT, INSERT, UPDATE, DELETE on sessions TO gopherbb_user;
+GRANT SELECT, INSERT, UPDATE, DELETE on recovery_codes TO gopherbb_user;
+GRANT SELECT, INSERT, UPDATE, DELETE on login_failures TO gopherbb_user;
+GRANT SELECT, INSERT, UPDATE, DELETE on login_locks TO gopherbb_user;
+GRANT SELECT, INSERT, DELETE on used_challenges TO gopherbb_user;
+GRANT SELECT, INSERT, UPDATE on invites TO gopherbb_user;
+GRANT SELECT, INSERT, UPDATE on password_resets TO gopherbb_user;
+GRANT SELECT, INSERT, UPDATE on email_verifications TO gopherbb_user;
+GRANT SELECT, INSERT, UPDATE, DELETE on identities TO gopherbb_user;
+GRANT SELECT, INSERT, UPDATE, DELETE on api_tokens TO gopherbb_user;
+GRANT SELECT, INSERT, UPDATE on sanctions TO gopherbb_user;
+-- the log is append only
+GRANT SELECT, INSERT on mod_actions TO gopherbb_user;
+GRANT SELECT, INSERT, UPDATE on reports TO gopherbb_user;
 
 GRANT USAGE, SELECT,UPDATE on users_id_seq TO gopherbb_user;
 GRANT USAGE, SELECT,UPDATE on likes_id_seq TO gopherbb_user;
 GRANT USAGE, SELECT,UPDATE on notifications_id_seq TO gopherbb_user;
 GRANT USAGE, SELECT,UPDATE on posts_id_seq TO gopherbb_user;
 GRANT USAGE, SELECT,UPDATE on comments_id_seq TO gopherbb_user;
+GRANT USAGE, SELECT,UPDATE on comment_likes_id_seq TO gopherbb_user;
+GRANT USAGE, SELECT,UPDATE on comment_revisions_id_seq TO gopherbb_user;
+GRANT USAGE, SELECT,UPDATE on sessions_id_seq TO gopherbb_user;
+GRANT USAGE, SELECT,UPDATE on recovery_codes_id_seq TO gopherbb_user;
+GRANT USAGE, SELECT,UPDATE on login_failures_id_seq TO gopherbb_user;
+GRANT USAGE, SELECT,UPDATE on invites_id_seq TO gopherbb_user;
+GRANT USAGE, SELECT,UPDATE on password_resets_id_seq TO gopherbb_user;
+GRANT USAGE, SELECT,UPDATE on email_verifications_id_seq TO gopherbb_user;
+GRANT USAGE, SELECT,UPDATE on identities_id_seq TO gopherbb_user;
+GRANT USAGE, SELECT,UPDATE on api_tokens_id_seq TO gopherbb_user;
+GRANT USAGE, SELECT,UPDATE on sanctions_id_seq TO gopherbb_user;
+GRANT USAGE, SELECT,UPDATE on mod_actions_id_seq TO gopherbb_user;
+GRANT USAGE, SELECT,UPDATE on reports_id_seq TO gopherbb_user;
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/0sm1les/gopherbb/models"
+	"github.com/0sm1les/gopherbb/throttle"
+
+	"github.com/gin-gonic/gin"
+)
+
+var limiter *throttle.Limiter
+
+var ipMaxFailures, accountMaxFailures int
+
+// setupThrottle builds the login limiter from config, unset values get a sane default
+func setupThrottle(conf models.ThrottleConfig) error {
+	window, err := durationOr(conf.Window, 15*time.Minute)
+	if err != nil {
+		return err
+	}
+	lockout, err := durationOr(conf.Lockout, time.Minute)
+	if err != nil {
+		return err
+	}
+	max_lockout, err := durationOr(conf.Max_lockout, time.Hour)
+	if err != nil {
+		return err
+	}
+
+	ipMaxFailures = conf.Ip_max_failures
+	if ipMaxFailures == 0 {
+		ipMaxFailures = 20
+	}
+	accountMaxFailures = conf.Account_max_failures
+	if accountMaxFailures == 0 {
+		accountMaxFailures = 5
+	}
+
+	var backend throttle.Store
+	switch conf.Backend {
+	case "", "memory":
+		backend = throttle.NewMemory()
+	case "postgres":
+		backend = throttle.NewPostgres()
+	default:
+		return errors.New("throttle backend must be memory or postgres")
+	}
+	limiter = throttle.New(backend, window, lockout, max_lockout)
+	return nil
+}
+
+func durationOr(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func purgeThrottle() {
+	for range time.Tick(time.Hour) {
+		if err := limiter.Purge(); err != nil {
+			logger.Error().Err(err).Msg("")
+		}
+	}
+}
+
+func ipKey(c *gin.Context) string {
+	return "ip:" + clientIP(c.Request)
+}
+
+func accountKey(username models.Username) string {
+	return "user:" + string(username)
+}
+
+// loginLocked returns an error for the login form if the ip or account is locked out
+func loginLocked(c *gin.Context, username models.Username) (string, error) {
+	remaining, err := limiter.Locked(ipKey(c), accountKey(username))
+	if err != nil || remaining <= 0 {
+		return "", err
+	}
+	minutes := int(math.Ceil(remaining.Minutes()))
+	if minutes == 1 {
+		return "Too many failed login attempts. Try again in 1 minute.", nil
+	}
+	return fmt.Sprintf("Too many failed login attempts. Try again in %d minutes.", minutes), nil
+}
+
+// loginFailed records a failed attempt and returns the message shown on the login form
+func loginFailed(c *gin.Context, username models.Username, message string) string {
+	if _, err := limiter.Fail(ipKey(c), ipMaxFailures); err != nil {
+		logger.Error().Err(err).Msg("")
+	}
+	left, err := limiter.Fail(accountKey(username), accountMaxFailures)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return message
+	}
+	if locked, _ := loginLocked(c, username); locked != "" {
+		return locked
+	}
+	if left == 1 {
+		return message + " 1 attempt left before a temporary lockout."
+	} else if left == 2 {
+		return message + " 2 attempts left before a temporary lockout."
+	}
+	return message
+}
+
+func loginSucceeded(username models.Username) {
+	if err := limiter.Succeed(accountKey(username)); err != nil {
+		logger.Error().Err(err).Msg("")
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+
+	"github.com/0sm1les/gopherbb/auth"
+	"github.com/0sm1les/gopherbb/mailer"
+	"github.com/0sm1les/gopherbb/models"
+	"github.com/0sm1les/gopherbb/querydb"
+
+	"github.com/gin-gonic/gin"
+)
+
+// outbox is nil when no mail backend is configured
+var outbox mailer.Mailer
+
+const (
+	emailVerificationLifetime = 48 * time.Hour
+	emailResetLifetime        = time.Hour
+)
+
+// sendMail delivers msg in the background so a slow relay doesn't hold up the request
+func sendMail(msg mailer.Message) bool {
+	if outbox == nil {
+		logger.Warn().Str("subject", msg.Subject).Msg("mail is not configured, dropping message")
+		return false
+	}
+	go func() {
+		if err := outbox.Send(msg); err != nil {
+			logger.Error().Err(err).Str("subject", msg.Subject).Msg("sending mail failed")
+		}
+	}()
+	return true
+}
+
+func siteURL(path string) string {
+	return strings.TrimRight(config.Mail.Base_url, "/") + path
+}
+
+// verifiedEmailMissing reports whether config requires a verified email that user does not have
+func verifiedEmailMissing(userinfo models.User) bool {
+	return config.Require_verified_email && !userinfo.Email_verified
+}
+
+// sendVerification stores email as the user's unverified address and mails them a link to verify it
+func sendVerification(user_id int32, username models.Username, email string) error {
+	token, err := auth.NewToken()
+	if err != nil {
+		return err
+	}
+	if err := querydb.SetEmail(user_id, email, auth.HashToken(token), int64(emailVerificationLifetime.Seconds())); err != nil {
+		return err
+	}
+	sendMail(mailer.Message{
+		To:      email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Hi %s,\n\nopen this link to verify your email address:\n\n%s\n\nThe link expires in %d hours. If you did not ask for this you can ignore this mail.\n",
+			username,
+			siteURL("/verify/"+token),
+			int(emailVerificationLifetime.Hours())),
+	})
+	return nil
+}
+
+func setEmail(uid int32, c *gin.Context) {
+	userinfo, err := querydb.Userinfo(uid)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+
+	email, err := mailer.ValidateAddress(c.PostForm("email"))
+	if err != nil {
+		html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": err.Error()})
+		return
+	}
+
+	if err := sendVerification(uid, userinfo.Username, email); err != nil {
+		logger.Error().Err(err).Msg("")
+		html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "error setting email"})
+		return
+	}
+	html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+	html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "ok", "Message": "check your inbox for a verification link"})
+}
+
+func setDigest(uid int32, c *gin.Context) {
+	enabled := c.PostForm("digest") == "on"
+	if err := querydb.SetEmailDigest(uid, enabled); err != nil {
+		logger.Error().Err(err).Msg("")
+		html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "error updating digest"})
+		return
+	}
+	message := "digest disabled"
+	if enabled {
+		message = "digest enabled"
+	}
+	html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+	html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "ok", "Message": message})
+}
+
+func verifyEmail(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	c.Header("Referrer-Policy", "no-referrer")
+
+	message := "Email verified."
+	if _, err := querydb.VerifyEmail(auth.HashToken(c.Param("token"))); err != nil {
+		if err != querydb.ErrInvalidVerification {
+			logger.Error().Err(err).Msg("")
+		}
+		message = querydb.ErrInvalidVerification.Error()
+	}
+
+	if uid != -1 {
+		userinfo, err := querydb.Userinfo(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/message.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "verify email", "Userinfo": userinfo, "Csrf": csrfToken(c)})
+		html.ExecuteTemplate(c.Writer, "html/message.html", gin.H{"Message": message})
+		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
+	} else {
+		html := template.Must(newTemplate().ParseFiles("html/unauth_header.html", "html/message.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "verify email", "Registration": config.Registration, "Csrf": csrfToken(c)})
+		html.ExecuteTemplate(c.Writer, "html/message.html", gin.H{"Message": message})
+		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
+	}
+}
+
+// forgotPassword mails a reset link to users with a verified email. The
+// response is the same whether or not the account exists.
+func forgotPassword(c *gin.Context) {
+	initsession(c)
+	render := func(notice string) {
+		html := template.Must(newTemplate().ParseFiles("html/unauth_header.html", "html/forgot.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "Reset password", "Registration": config.Registration, "Csrf": csrfToken(c)})
+		html.ExecuteTemplate(c.Writer, "html/forgot.html", gin.H{"Notice": notice, "Csrf": csrfToken(c)})
+		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
+	}
+
+	if c.Request.Method == "GET" {
+		render("")
+		return
+	}
+
+	notice := "If that account has a verified email address a reset link is on its way."
+	username, err := auth.ValidateUser(c.PostForm("username"))
+	if err != nil {
+		render(notice)
+		return
+	}
+
+	// every request counts against the limiter so the form can't be used to flood an inbox
+	key := "reset:" + string(username)
+	if locked, err := limiter.Locked(key); err != nil || locked > 0 {
+		render(notice)
+		return
+	}
+	if _, err := limiter.Fail(key, 3); err != nil {
+		logger.Error().Err(err).Msg("")
+	}
+
+	user_id := querydb.UserExists(username)
+	if user_id == -1 {
+		render(notice)
+		return
+	}
+	userinfo, err := querydb.Userinfo(user_id)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		render(notice)
+		return
+	}
+	if !userinfo.Email_verified || userinfo.Status != "active" {
+		render(notice)
+		return
+	}
+
+	token, err := auth.NewToken()
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		render(notice)
+		return
+	}
+	if err := querydb.NewPasswordReset(user_id, user_id, auth.HashToken(token), int64(emailResetLifetime.Seconds()), nil); err != nil {
+		logger.Error().Err(err).Msg("")
+		render(notice)
+		return
+	}
+	sendMail(mailer.Message{
+		To:      userinfo.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nopen this link to choose a new password:\n\n%s\n\nThe link expires in %d minutes. If you did not ask for this you can ignore this mail.\n",
+			userinfo.Username,
+			siteURL("/reset/"+token),
+			int(emailResetLifetime.Minutes())),
+	})
+	render(notice)
+}
+
+// mailDigests sends each opted in user their unread notifications when the
+// process starts and then once a day
+func mailDigests() {
+	sendDigests()
+	for range time.Tick(24 * time.Hour) {
+		sendDigests()
+	}
+}
+
+// sendDigests mails the digests synchronously so a user's digest only moves
+// past notifications the relay has accepted, a failed send is retried next time
+func sendDigests() {
+	users, err := querydb.DigestUsers()
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	for _, user := range users {
+		notifications, err := querydb.DigestNotifications(user.Id)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			continue
+		}
+		if len(notifications) == 0 {
+			continue
+		}
+		for i := 0; i < len(notifications); i++ {
+			notifications[i].From_Uid_Listing, err = querydb.GetUser(notifications[i].From_Uid)
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+			}
+		}
+
+		var buf bytes.Buffer
+		html := template.Must(newTemplate().ParseFiles("html/mail/digest.html"))
+		err = html.ExecuteTemplate(&buf, "html/mail/digest.html", gin.H{"Username": user.Username, "Notifications": notifications, "Base_url": strings.TrimRight(config.Mail.Base_url, "/")})
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			continue
+		}
+
+		if err := outbox.Send(mailer.Message{To: user.Email, Subject: "Your unread notifications", Body: buf.String(), HTML: true}); err != nil {
+			logger.Error().Err(err).Str("username", string(user.Username)).Msg("sending digest failed")
+			continue
+		}
+		if err := querydb.SetDigestNid(user.Id, notifications[len(notifications)-1].Nid); err != nil {
+			logger.Error().Err(err).Msg("")
+		}
+	}
+}
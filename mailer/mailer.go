@@ -0,0 +1,116 @@
+// Package mailer sends outbound mail through SMTP, or writes it to a file or
+// stdout during development.
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/0sm1les/gopherbb/models"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+	// send Body as text/html instead of text/plain
+	HTML bool
+}
+
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// New returns the backend selected in config. An empty backend disables mail
+// and returns a nil Mailer.
+func New(conf models.MailConfig) (Mailer, error) {
+	switch conf.Backend {
+	case "":
+		return nil, nil
+	case "smtp":
+		if conf.Smtp_host == "" || conf.From == "" {
+			return nil, errors.New("smtp mail needs Smtp_host and From")
+		}
+		return &SMTP{
+			Host:     conf.Smtp_host,
+			Port:     conf.Smtp_port,
+			Username: conf.Smtp_username,
+			Password: os.Getenv("gopherbb_smtp_password"),
+			TLS:      conf.Smtp_tls,
+			From:     conf.From,
+		}, nil
+	case "file":
+		if conf.File == "" {
+			return nil, errors.New("file mail needs File")
+		}
+		f, err := os.OpenFile(conf.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0660)
+		if err != nil {
+			return nil, err
+		}
+		return &Writer{Out: f, From: conf.From}, nil
+	case "log":
+		return &Writer{Out: os.Stdout, From: conf.From}, nil
+	}
+	return nil, fmt.Errorf("unknown mail backend %q", conf.Backend)
+}
+
+// ValidateAddress returns the bare address from user input like "Name <a@b.c>"
+func ValidateAddress(address string) (string, error) {
+	parsed, err := mail.ParseAddress(strings.TrimSpace(address))
+	if err != nil {
+		return "", errors.New("invalid email address")
+	}
+	if len(parsed.Address) > 255 {
+		return "", errors.New("email address is too long")
+	}
+	return parsed.Address, nil
+}
+
+// build renders msg as an RFC 5322 message
+func (msg Message) build(from string) ([]byte, error) {
+	if strings.ContainsAny(msg.To, "\r\n") || strings.ContainsAny(from, "\r\n") {
+		return nil, errors.New("invalid address")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at != -1 {
+		domain = strings.Trim(from[at+1:], ">")
+	}
+
+	content_type := "text/plain"
+	if msg.HTML {
+		content_type = "text/html"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: %s; charset=utf-8\r\n", content_type)
+	fmt.Fprintf(&buf, "Content-Transfer-Encoding: 8bit\r\n")
+	fmt.Fprintf(&buf, "\r\n")
+
+	// normalize line endings and escape lines starting with a dot
+	for _, line := range strings.Split(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n") {
+		if strings.HasPrefix(line, ".") {
+			line = "." + line
+		}
+		buf.WriteString(line + "\r\n")
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,114 @@
+package mailer
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeRelay is a minimal SMTP server that accepts one connection and keeps
+// the message it was given. Recipients in reject are refused.
+type fakeRelay struct {
+	listener net.Listener
+	reject   string
+	done     chan string
+}
+
+func newFakeRelay(t *testing.T, reject string) *fakeRelay {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := &fakeRelay{listener: listener, reject: reject, done: make(chan string, 1)}
+	go relay.serve()
+	t.Cleanup(func() { listener.Close() })
+	return relay
+}
+
+func (r *fakeRelay) serve() {
+	conn, err := r.listener.Accept()
+	if err != nil {
+		r.done <- ""
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	var data strings.Builder
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			r.done <- data.String()
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250-localhost")
+			reply("250 8BITMIME")
+		case strings.HasPrefix(command, "MAIL FROM"):
+			reply("250 ok")
+		case strings.HasPrefix(command, "RCPT TO"):
+			if r.reject != "" && strings.Contains(command, strings.ToUpper(r.reject)) {
+				reply("550 no such user")
+			} else {
+				reply("250 ok")
+			}
+		case command == "DATA":
+			reply("354 go ahead")
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			reply("250 queued")
+		case command == "QUIT":
+			reply("221 bye")
+			r.done <- data.String()
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (r *fakeRelay) mailer() *SMTP {
+	address := r.listener.Addr().(*net.TCPAddr)
+	return &SMTP{Host: "127.0.0.1", Port: address.Port, From: "gopherbb <noreply@example.com>"}
+}
+
+func TestSMTPSend(t *testing.T) {
+	relay := newFakeRelay(t, "")
+	msg := Message{To: "user@example.com", Subject: "Your unread notifications", Body: "<p>hi</p>\n.hidden", HTML: true}
+	if err := relay.mailer().Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	data := <-relay.done
+	for _, want := range []string{"To: user@example.com\r\n", "Content-Type: text/html; charset=utf-8\r\n", "<p>hi</p>\r\n", "..hidden\r\n"} {
+		if !strings.Contains(data, want) {
+			t.Errorf("message is missing %q:\n%s", want, data)
+		}
+	}
+}
+
+func TestSMTPSendRejected(t *testing.T) {
+	relay := newFakeRelay(t, "gone@example.com")
+	if err := relay.mailer().Send(Message{To: "gone@example.com", Subject: "digest", Body: "hi"}); err == nil {
+		t.Fatal("a rejected recipient was reported as sent")
+	}
+}
+
+func TestSMTPSendUnreachable(t *testing.T) {
+	relay := newFakeRelay(t, "")
+	smtp := relay.mailer()
+	relay.listener.Close()
+	if err := smtp.Send(Message{To: "user@example.com", Subject: "digest", Body: "hi"}); err == nil {
+		t.Fatal("a relay that can't be reached was reported as sent")
+	}
+}
@@ -0,0 +1,27 @@
+package mailer
+
+import (
+	"io"
+	"sync"
+)
+
+// Writer appends every message to Out instead of sending it, for development
+type Writer struct {
+	mu   sync.Mutex
+	Out  io.Writer
+	From string
+}
+
+func (w *Writer) Send(msg Message) error {
+	data, err := msg.build(w.From)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.Out.Write(data); err != nil {
+		return err
+	}
+	_, err = w.Out.Write([]byte("\r\n"))
+	return err
+}
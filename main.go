@@ -10,19 +10,23 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/0sm1les/gopherbb/auth"
+	"github.com/0sm1les/gopherbb/mailer"
 	"github.com/0sm1les/gopherbb/models"
 	"github.com/0sm1les/gopherbb/querydb"
 
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/sessions"
+	"github.com/gin-gonic/gin/binding"
 	"github.com/yuin/goldmark"
 	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/util"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -30,14 +34,15 @@ import (
 	highlighting "github.com/yuin/goldmark-highlighting/v2"
 )
 
-var store = sessions.NewCookieStore([]byte(os.Getenv("gopherbb_cookie_key")))
+var store = newDBStore([]byte(os.Getenv("gopherbb_cookie_key")))
 
-var Sections = make(map[string]string)
+var Sections = make(map[string]models.Section)
 
 var config models.Config
 
 var md = goldmark.New(goldmark.WithExtensions(extension.GFM,
-	highlighting.NewHighlighting(highlighting.WithStyle("monokai"))))
+	highlighting.NewHighlighting(highlighting.WithStyle("monokai"))),
+	goldmark.WithParserOptions(parser.WithASTTransformers(util.Prioritized(relTransformer{}, 1000))))
 
 var logger zerolog.Logger
 
@@ -87,11 +92,14 @@ func main() {
 	}
 	readConf(file_cf)
 
+	// only needed to verify password hashes from before per-user salts
 	salt, supplied := os.LookupEnv("gopherbb_salt")
-	if !supplied {
-		logger.Fatal().Msg("env variable 'gopherbb_salt' is not set")
+	if supplied {
+		auth.SetSalt(salt)
+	} else {
+		logger.Info().Msg("env variable 'gopherbb_salt' is not set, legacy password hashes can not be verified")
 	}
-	auth.SetSalt(salt)
+	auth.SetParams(config.Argon2)
 
 	_, supplied = os.LookupEnv("gopherbb_cookie_key")
 	if !supplied {
@@ -117,13 +125,88 @@ func main() {
 		logger.Fatal().Err(err)
 	}
 
+	if err := setupThrottle(config.Throttle); err != nil {
+		logger.Fatal().Err(err).Msg("invalid throttle config")
+	}
+	go purgeThrottle()
+
+	idle, absolute, err := parseTimeouts(config.Sessions)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid session timeout in config")
+	}
+	store.SetTimeouts(idle, absolute)
+	if err := setupTrustedProxies(config.Trusted_proxies); err != nil {
+		logger.Fatal().Err(err).Msg("invalid trusted proxies in config")
+	}
+	go purgeSessions()
+
+	if err := setupRoles(config.Roles); err != nil {
+		logger.Fatal().Err(err).Msg("invalid roles in config")
+	}
+	if err := validateSectionAccess(); err != nil {
+		logger.Fatal().Err(err).Msg("invalid section access in config")
+	}
+
+	if err := setupPolicy(config.Policy, config.Unranked); err != nil {
+		logger.Fatal().Err(err).Msg("invalid content policy in config")
+	}
+	go reloadPolicy(file_cf)
+
+	if err := setupComments(config.Comments); err != nil {
+		logger.Fatal().Err(err).Msg("invalid comment config")
+	}
+
+	if err := setupRateLimits(config.Rate_limits); err != nil {
+		logger.Fatal().Err(err).Msg("invalid rate limits in config")
+	}
+	go purgeBuckets()
+
+	if err := setupSpam(config.Spam, config.Throttle.Backend); err != nil {
+		logger.Fatal().Err(err).Msg("invalid spam config")
+	}
+	go purgeChallenges()
+
+	if err := setupTrash(config.Trash); err != nil {
+		logger.Fatal().Err(err).Msg("invalid trash config")
+	}
+	if trashRetention > 0 {
+		go purgeDeleted()
+	}
+
+	if err := setupPromotion(config.Promotion, config.Unranked); err != nil {
+		logger.Fatal().Err(err).Msg("invalid promotion config")
+	}
+	if promotionInterval > 0 {
+		go promoteUsers()
+	}
+
+	if err := setupProviders(config.Oidc); err != nil {
+		logger.Fatal().Err(err).Msg("invalid oidc config")
+	}
+
+	outbox, err = mailer.New(config.Mail)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid mail config")
+	}
+	if outbox != nil {
+		go mailDigests()
+	}
+
 	router := gin.Default()
+	if err := router.SetTrustedProxies(config.Trusted_proxies); err != nil {
+		logger.Fatal().Err(err).Msg("invalid trusted proxies in config")
+	}
+	router.Use(apiTokenAuth)
+	router.Use(csrfProtect)
+	router.Use(twoFactorEnrollment)
 
 	router.NoRoute(func(c *gin.Context) {
 		index(c)
 	})
 
 	router.Static("/pictures", "html/user_pictures")
+	// the pages use the same helpers as newTemplate
+	router.SetFuncMap(template.FuncMap{"can": can})
 	router.LoadHTMLGlob("./html/*.html")
 	router.StaticFile("/DroidSansMono.ttf", "./html/static/DroidSansMono.ttf")
 	router.LoadHTMLFiles("./html/static/gopherbb.css")
@@ -132,50 +215,99 @@ func main() {
 	router.GET("/", index)
 	router.GET("/login", login)
 	router.POST("/login", login)
+	router.GET("/login/2fa", loginTwoFactor)
+	router.POST("/login/2fa", loginTwoFactor)
+	router.GET("/login/oidc/:provider", oidcStart)
+	router.GET("/login/oidc/:provider/callback", oidcCallback)
+	router.POST("/login/oidc/username", oidcUsername)
 	router.GET("/register", register)
 	router.POST("/register", register)
-	router.GET("/logout", logout)
+	router.POST("/logout", logout)
 	router.GET("/search", search)
 
 	router.GET("/user/settings", settings)
 	router.POST("/user/settings/:setting", settings)
+	router.GET("/user/settings/sessions", userSessions)
+	router.GET("/mod/approvals", requireCapability(capUserApprove), approvals)
+	router.POST("/mod/approvals/:uid/:decision", requireCapability(capUserApprove), approvals)
+	router.GET("/mod/queue", requireCapability(capPostApprove), postQueue)
+	router.GET("/admin", requireCapability(capDashboardView), dashboard)
+	router.GET("/admin/users", requireCapability(capDashboardView), searchUsers)
+	router.POST("/admin/users/:user/role", requireCapability(capUserRole), setUserRole)
+	router.POST("/admin/restore/:target/:id", requireCapability(capContentRestore), restoreContent)
+	router.GET("/mod/trash", requireCapability(capContentRestore), modTrash)
+	router.GET("/admin/modlog", requireCapability(capModLogView), modLog)
+	router.GET("/admin/modlog/export", requireCapability(capModLogView), exportModLog)
+	router.POST("/mod/queue/:pid/:decision", requireCapability(capPostApprove), postQueue)
+	router.GET("/mod/reports", requireCapability(capReportReview), reportQueue)
+	router.POST("/mod/reports/:target/:id/:decision", requireCapability(capReportReview), reportQueue)
+	router.GET("/report/:target/:id", requireCapability(capReportCreate), reportContent)
+	router.POST("/mod/thread/:pid/lock", requireCapability(capPostLock), lockThread)
+	router.DELETE("/mod/thread/:pid/lock", requireCapability(capPostLock), lockThread)
+	router.POST("/mod/thread/:pid/pin", requireCapability(capPostPin), pinThread)
+	router.DELETE("/mod/thread/:pid/pin", requireCapability(capPostPin), pinThread)
+	router.POST("/mod/thread/:pid/move", requireCapability(capPostMove), moveThread)
+	router.POST("/report/:target/:id", requireCapability(capReportCreate), reportContent)
+	router.DELETE("/user/settings/sessions/:sid", revokeSession)
+	router.DELETE("/user/settings/identities/:provider", unlinkIdentity)
+	router.DELETE("/user/settings/tokens/:id", revokeAPIToken)
+	router.DELETE("/user/:user/sessions", requireCapability(capUserSessions), revokeUserSessions)
+	router.POST("/user/:user/password-reset", requireCapability(capUserPasswordReset), adminPasswordReset)
+	router.POST("/user/:user/sanctions", requireCapability(capUserBan), sanctionUser)
+	router.DELETE("/user/:user/sanctions/:id", requireCapability(capUserBan), liftSanction)
+	router.GET("/reset", forgotPassword)
+	router.POST("/reset", forgotPassword)
+	router.GET("/verify/:token", verifyEmail)
+	router.GET("/reset/:token", resetPassword)
+	router.POST("/reset/:token", resetPassword)
 	router.GET("/user/:user", profile)
 	router.GET("/user/:user/posts", posts)
 	router.GET("/user/drafts", drafts)
+	router.GET("/user/trash", trash)
+	router.POST("/user/trash/:target/:id", restoreOwn)
 	router.GET("/user/likes", likes)
 	router.GET("/user/notifications", notifications)
 
-	router.GET("/editor", editor)
-	router.GET("/editor/:id", editor)
+	router.GET("/editor", requireCapability(capPostCreate), editor)
+	router.GET("/editor/:id", requireCapability(capPostCreate), editor)
 
-	router.POST("/editor/render", render)
+	router.POST("/editor/render", requireCapability(capPostCreate), render)
 
-	router.POST("/editor/save", save)
-	router.POST("/editor/:id/save", save)
+	router.POST("/editor/save", requireCapability(capPostCreate), save)
+	router.POST("/editor/:id/save", requireCapability(capPostCreate), save)
 
-	router.POST("/editor/post", post)
-	router.POST("/editor/:id/post", post)
+	router.POST("/editor/post", requireCapability(capPostCreate), rateLimited(actionPost), post)
+	router.POST("/editor/:id/post", requireCapability(capPostCreate), rateLimited(actionPost), post)
 
-	router.GET("/delete/post/:pid", deletePost)
-	router.GET("/delete/reply/:cid", deleteReply)
+	router.DELETE("/delete/post/:pid", deletePost)
+	router.DELETE("/delete/reply/:cid", deleteReply)
+	router.GET("/edit/reply/:cid", editReply)
+	router.POST("/edit/reply/:cid", editReply)
+	router.GET("/mod/comment/:cid/history", requireCapability(capCommentHistory), commentHistory)
 
 	router.GET("/section/:section", section)
 	router.GET("/section/:section/mostliked", mostLiked)
 	router.GET("/section/:section/newest", newest)
 	router.GET("/section/:section/:id/:title", viewPost)
 
-	router.GET("/reply/:pid/comment/:cid", reply)
-	router.POST("/reply/:pid/comment/:cid", reply)
-	router.GET("/reply/:pid", reply)
-	router.POST("/reply/:pid", reply)
+	router.GET("/reply/:pid/comment/:cid", requireCapability(capCommentCreate), reply)
+	router.POST("/reply/:pid/comment/:cid", requireCapability(capCommentCreate), rateLimited(actionReply), reply)
+	router.GET("/reply/:pid", requireCapability(capCommentCreate), reply)
+	router.POST("/reply/:pid", requireCapability(capCommentCreate), rateLimited(actionReply), reply)
 
 	router.GET("/raw/:pid/:title", rawMD)
 
-	router.GET("/like/:pid", like)
+	router.POST("/like/:pid", requireCapability(capPostLike), rateLimited(actionLike), like)
+	router.POST("/like/:pid/comment/:cid", requireCapability(capPostLike), rateLimited(actionLike), likeComment)
 
 	router.Run("localhost:8080")
 }
 
+// newTemplate returns an empty template set with the helpers every page can use
+func newTemplate() *template.Template {
+	return template.New("").Funcs(template.FuncMap{"can": can})
+}
+
 func formattedTime(rawtime time.Time) string {
 	return rawtime.Format("2006-01-02")
 }
@@ -191,14 +323,18 @@ func readConf(conf_file string) {
 	}
 	for i := 0; i < len(config.Categories); i++ {
 		for j := 0; j < len(config.Categories[i].Sections); j++ {
-			Sections[config.Categories[i].Sections[j].Id] = config.Categories[i].Sections[j].Section
+			Sections[config.Categories[i].Sections[j].Id] = config.Categories[i].Sections[j]
 		}
 	}
 }
 
+func registrationOpen() bool {
+	return config.Registration == "open" || config.Registration == "invite" || config.Registration == "approval"
+}
+
 func validateSection(sectionId string) (models.Section, error) {
 	if val, ok := Sections[sectionId]; ok {
-		return models.Section{Section: val, Id: sectionId}, nil
+		return val, nil
 	}
 	return models.Section{}, errors.New("section does not exist")
 }
@@ -214,8 +350,17 @@ func randomString() string {
 
 func initsession(c *gin.Context) error {
 	session, _ := store.Get(c.Request, "session")
-	if session.IsNew {
-		session.Values["id"] = int32(-1)
+	_, hasId := session.Values["id"].(int32)
+	_, hasCsrf := session.Values["csrf"].(string)
+	if session.IsNew || !hasId || !hasCsrf {
+		if !hasId {
+			session.Values["id"] = int32(-1)
+		}
+		if !hasCsrf {
+			if err := newCSRFToken(session); err != nil {
+				return err
+			}
+		}
 		if err := session.Save(c.Request, c.Writer); err != nil {
 			return err
 		}
@@ -225,6 +370,12 @@ func initsession(c *gin.Context) error {
 
 func authsesssion(id int32, c *gin.Context) error {
 	session, _ := store.Get(c.Request, "session")
+	if err := store.rotate(session); err != nil {
+		return err
+	}
+	if err := newCSRFToken(session); err != nil {
+		return err
+	}
 	session.Values["id"] = id
 	if err := session.Save(c.Request, c.Writer); err != nil {
 		return err
@@ -247,7 +398,7 @@ func css(c *gin.Context) {
 	uid := session.Values["id"].(int32)
 
 	c.Header("Content-Type", "text/css; charset=utf-8")
-	css := template.Must(template.ParseFiles("html/static/gopherbb.css"))
+	css := template.Must(newTemplate().ParseFiles("html/static/gopherbb.css"))
 
 	if uid != -1 {
 		theme, err := querydb.GetTheme(uid)
@@ -266,8 +417,9 @@ func index(c *gin.Context) {
 	initsession(c)
 	session, _ := store.Get(c.Request, "session")
 	uid := session.Values["id"].(int32)
+	reader := viewer(uid)
 
-	recentPosts, err := querydb.RecentPosts()
+	recentPosts, err := querydb.RecentPosts(visibleSections(reader))
 	if err != nil {
 		logger.Error().Err(err).Msg("")
 		return
@@ -281,14 +433,14 @@ func index(c *gin.Context) {
 	}
 	if uid != -1 {
 		userinfo, _ := querydb.Userinfo(uid)
-		html := template.Must(template.ParseFiles("html/auth_header.html", "html/index.html", "html/footer.html"))
-		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "Index", "Userinfo": userinfo})
-		html.ExecuteTemplate(c.Writer, "html/index.html", gin.H{"Categories": config.Categories, "Recentposts": recentPosts})
+		html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/index.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "Index", "Userinfo": userinfo, "Csrf": csrfToken(c)})
+		html.ExecuteTemplate(c.Writer, "html/index.html", gin.H{"Categories": visibleCategories(reader, canRead), "Recentposts": recentPosts})
 		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 	} else {
-		html := template.Must(template.ParseFiles("html/unauth_header.html", "html/index.html", "html/footer.html"))
-		html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "Index", "Registration": config.Registration})
-		html.ExecuteTemplate(c.Writer, "html/index.html", gin.H{"Categories": config.Categories, "Recentposts": recentPosts})
+		html := template.Must(newTemplate().ParseFiles("html/unauth_header.html", "html/index.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "Index", "Registration": config.Registration, "Csrf": csrfToken(c)})
+		html.ExecuteTemplate(c.Writer, "html/index.html", gin.H{"Categories": visibleCategories(reader, canRead), "Recentposts": recentPosts})
 		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 	}
 }
@@ -299,9 +451,9 @@ func login(c *gin.Context) {
 	uid := session.Values["id"].(int32)
 	if uid == -1 {
 		if c.Request.Method == "GET" {
-			html := template.Must(template.ParseFiles("html/unauth_header.html", "html/login.html", "html/footer.html"))
-			html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "Login", "Registration": config.Registration})
-			html.ExecuteTemplate(c.Writer, "html/login.html", gin.H{"Registration": config.Registration})
+			html := template.Must(newTemplate().ParseFiles("html/unauth_header.html", "html/login.html", "html/footer.html"))
+			html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "Login", "Registration": config.Registration, "Csrf": csrfToken(c)})
+			html.ExecuteTemplate(c.Writer, "html/login.html", gin.H{"Registration": config.Registration, "Providers": providerList, "Csrf": csrfToken(c)})
 			html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 		} else if c.Request.Method == "POST" {
 			username := c.PostForm("username")
@@ -318,19 +470,76 @@ func login(c *gin.Context) {
 				inputErrors = append(inputErrors, err.Error())
 			}
 
+			loginError := "Incorrect username/password."
+
+			// checked before hashing so a locked out attacker can't burn argon2 memory
 			if len(inputErrors) == 0 {
-				user_id, err := querydb.Authenticate(verified_user, auth.Hashpassword(verified_pass))
+				locked, err := loginLocked(c, verified_user)
 				if err != nil {
+					logger.Error().Err(err).Msg("")
+				}
+				if locked != "" {
+					loginError = locked
+					inputErrors = append(inputErrors, locked)
+				}
+			}
+
+			if len(inputErrors) == 0 {
+				user_id, hash, err := querydb.Authenticate(verified_user)
+				if err != nil {
+					// hash anyway so unknown usernames take as long as wrong passwords
+					auth.Hashpassword(verified_pass)
+					loginError = loginFailed(c, verified_user, loginError)
 					inputErrors = append(inputErrors, err.Error())
+				} else if ok, err := auth.ComparePassword(verified_pass, hash); err != nil || !ok {
+					if err != nil {
+						logger.Error().Err(err).Msg("")
+					}
+					loginError = loginFailed(c, verified_user, loginError)
+					inputErrors = append(inputErrors, "incorrect password")
 				} else {
-					authsesssion(user_id, c)
-					index(c)
+					if auth.NeedsRehash(hash) {
+						upgraded, err := auth.Hashpassword(verified_pass)
+						if err != nil {
+							logger.Error().Err(err).Msg("")
+						} else if err := querydb.SetPassword(user_id, upgraded); err != nil {
+							logger.Error().Err(err).Msg("")
+						}
+					}
+					userinfo, err := querydb.Userinfo(user_id)
+					if err != nil {
+						logger.Error().Err(err).Msg("")
+						return
+					}
+					if userinfo.Status == "pending" {
+						loginError = "Your account is waiting for a moderator to approve it."
+						inputErrors = append(inputErrors, loginError)
+					} else if userinfo.Status == "rejected" {
+						loginError = "Your registration was not approved."
+						inputErrors = append(inputErrors, loginError)
+					} else if lockout, err := lockoutMessage(user_id); err != nil || lockout != "" {
+						if err != nil {
+							logger.Error().Err(err).Msg("")
+							return
+						}
+						loginError = lockout
+						inputErrors = append(inputErrors, loginError)
+					} else if userinfo.Totp_enabled {
+						startTwoFactor(user_id, c)
+						return
+					} else {
+						if err := completeLogin(userinfo, c); err != nil {
+							logger.Error().Err(err).Msg("")
+							return
+						}
+						index(c)
+					}
 				}
 			}
 			if len(inputErrors) != 0 {
-				html := template.Must(template.ParseFiles("html/unauth_header.html", "html/login.html", "html/footer.html"))
-				html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "Login", "Registration": config.Registration})
-				html.ExecuteTemplate(c.Writer, "html/login.html", gin.H{"Errors": []string{"Incorrect username/password."}, "Registration": config.Registration})
+				html := template.Must(newTemplate().ParseFiles("html/unauth_header.html", "html/login.html", "html/footer.html"))
+				html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "Login", "Registration": config.Registration, "Csrf": csrfToken(c)})
+				html.ExecuteTemplate(c.Writer, "html/login.html", gin.H{"Errors": []string{loginError}, "Registration": config.Registration, "Providers": providerList, "Csrf": csrfToken(c)})
 				html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 			}
 
@@ -342,18 +551,44 @@ func register(c *gin.Context) {
 	initsession(c)
 	session, _ := store.Get(c.Request, "session")
 	uid := session.Values["id"].(int32)
-	if uid == -1 && config.Registration == "open" {
+	if uid == -1 && registrationOpen() {
 		if c.Request.Method == "GET" {
-			html := template.Must(template.ParseFiles("html/unauth_header.html", "html/register.html", "html/footer.html"))
-			html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "Register", "Registration": config.Registration})
-			html.ExecuteTemplate(c.Writer, "html/register.html", nil)
+			html := template.Must(newTemplate().ParseFiles("html/unauth_header.html", "html/register.html", "html/spam.html", "html/footer.html"))
+			html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "Register", "Registration": config.Registration, "Csrf": csrfToken(c)})
+			html.ExecuteTemplate(c.Writer, "html/register.html", gin.H{"Registration": config.Registration,
+				"Invite":        c.Query("invite"),
+				"Require_email": config.Require_verified_email,
+				"Spam":          registrationChallenge(),
+				"Csrf":          csrfToken(c)})
 			html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 		} else if c.Request.Method == "POST" {
 			username := c.PostForm("username")
 			password := c.PostForm("password")
 			confirm_password := c.PostForm("confirm_password")
+			invite := strings.TrimSpace(c.PostForm("invite"))
+			email := strings.TrimSpace(c.PostForm("email"))
 			var inputErrors []string
 
+			if config.Spam.Registration {
+				var answer spamAnswer
+				c.ShouldBind(&answer)
+				if failed := checkSpam("register", answer); failed != "" {
+					inputErrors = append(inputErrors, failed)
+				}
+			}
+
+			if email != "" || config.Require_verified_email {
+				if verified_email, err := mailer.ValidateAddress(email); err != nil {
+					inputErrors = append(inputErrors, err.Error())
+				} else {
+					email = verified_email
+				}
+			}
+
+			if config.Registration == "invite" && invite == "" {
+				inputErrors = append(inputErrors, "an invite code is required")
+			}
+
 			verified_pass, err := auth.ValidatePassword(password)
 			if err != nil {
 				inputErrors = append(inputErrors, err.Error())
@@ -369,23 +604,55 @@ func register(c *gin.Context) {
 
 			if len(inputErrors) == 0 {
 				if querydb.UserExists(verified_user) == -1 {
-					err = querydb.CreateUser(verified_user, auth.Hashpassword(verified_pass))
+					hash, err := auth.Hashpassword(verified_pass)
 					if err != nil {
 						logger.Error().Err(err).Msg("")
 						return
 					}
-					html := template.Must(template.ParseFiles("html/unauth_header.html", "html/login.html", "html/footer.html"))
-					html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "Login", "Registration": config.Registration})
-					html.ExecuteTemplate(c.Writer, "html/login.html", nil)
-					html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
-					return
+					status := "active"
+					notice := ""
+					if config.Registration == "approval" {
+						status = "pending"
+						notice = "Account created. A moderator needs to approve it before you can log in."
+					}
+
+					if config.Registration == "invite" {
+						err = querydb.CreateInvitedUser(verified_user, hash, status, auth.HashToken(invite))
+					} else {
+						err = querydb.CreateUser(verified_user, hash, status)
+					}
+					if err == querydb.ErrInvalidInvite {
+						inputErrors = append(inputErrors, err.Error())
+					} else if err != nil {
+						logger.Error().Err(err).Msg("")
+						return
+					} else {
+						if email != "" {
+							if err := sendVerification(querydb.UserExists(verified_user), verified_user, email); err != nil {
+								logger.Error().Err(err).Msg("")
+							} else if notice == "" {
+								notice = "Account created. Check your inbox for a link to verify your email."
+							}
+						}
+						html := template.Must(newTemplate().ParseFiles("html/unauth_header.html", "html/login.html", "html/footer.html"))
+						html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "Login", "Registration": config.Registration, "Csrf": csrfToken(c)})
+						html.ExecuteTemplate(c.Writer, "html/login.html", gin.H{"Registration": config.Registration, "Notice": notice, "Csrf": csrfToken(c)})
+						html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
+						return
+					}
 				} else {
 					inputErrors = append(inputErrors, "user already exists")
 				}
 			}
-			html := template.Must(template.ParseFiles("html/unauth_header.html", "html/register.html", "html/footer.html"))
-			html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "Register", "Registration": config.Registration})
-			html.ExecuteTemplate(c.Writer, "html/register.html", gin.H{"Errors": inputErrors})
+			html := template.Must(newTemplate().ParseFiles("html/unauth_header.html", "html/register.html", "html/spam.html", "html/footer.html"))
+			html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "Register", "Registration": config.Registration, "Csrf": csrfToken(c)})
+			html.ExecuteTemplate(c.Writer, "html/register.html", gin.H{"Errors": inputErrors,
+				"Registration":  config.Registration,
+				"Invite":        invite,
+				"Email":         email,
+				"Require_email": config.Require_verified_email,
+				"Spam":          registrationChallenge(),
+				"Csrf":          csrfToken(c)})
 			html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 
 		}
@@ -398,7 +665,7 @@ func logout(c *gin.Context) {
 	uid := session.Values["id"].(int32)
 	if uid != -1 {
 		deauthsession(uid, c)
-		c.Redirect(302, "/")
+		c.Header("HX-Redirect", "/")
 	}
 }
 
@@ -426,7 +693,7 @@ func profile(c *gin.Context) {
 			logger.Error().Err(err).Msg("")
 		}
 
-		posts, err := querydb.RecentUserPosts(other_uid)
+		posts, err := querydb.RecentUserPosts(other_uid, visibleSections(viewer(uid)))
 		if err != nil {
 			logger.Error().Err(err).Msg("")
 		}
@@ -440,13 +707,20 @@ func profile(c *gin.Context) {
 			if err != nil {
 				logger.Error().Err(err).Msg("")
 			}
-			html := template.Must(template.ParseFiles("html/auth_header.html", "html/profile.html", "html/footer.html"))
-			html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": other_userinfo.Username, "Userinfo": userinfo})
-			html.ExecuteTemplate(c.Writer, "html/profile.html", gin.H{"Userinfo": other_userinfo, "RecentPosts": posts})
+			html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/profile.html", "html/footer.html"))
+			html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": other_userinfo.Username, "Userinfo": userinfo, "Csrf": csrfToken(c)})
+			var sanctions []models.Sanction
+			if can(userinfo.Role, capUserBan) {
+				sanctions, err = querydb.UserSanctions(other_uid)
+				if err != nil {
+					logger.Error().Err(err).Msg("")
+				}
+			}
+			html.ExecuteTemplate(c.Writer, "html/profile.html", gin.H{"Userinfo": other_userinfo, "RecentPosts": posts, "Viewer": userinfo, "Sanctions": sanctions})
 			html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 		} else {
-			html := template.Must(template.ParseFiles("html/unauth_header.html", "html/profile.html", "html/footer.html"))
-			html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": other_userinfo.Username, "Registration": config.Registration})
+			html := template.Must(newTemplate().ParseFiles("html/unauth_header.html", "html/profile.html", "html/footer.html"))
+			html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": other_userinfo.Username, "Registration": config.Registration, "Csrf": csrfToken(c)})
 			html.ExecuteTemplate(c.Writer, "html/profile.html", gin.H{"Userinfo": other_userinfo, "RecentPosts": posts})
 			html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 		}
@@ -464,9 +738,38 @@ func settings(c *gin.Context) {
 				logger.Error().Err(err).Msg("")
 			}
 
-			html := template.Must(template.ParseFiles("html/auth_header.html", "html/settings.html", "html/footer.html"))
-			html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "Settings", "Userinfo": userinfo})
-			html.ExecuteTemplate(c.Writer, "html/settings.html", gin.H{"Userinfo": userinfo})
+			var invites []models.Invite
+			if can(userinfo.Role, capInviteCreate) {
+				invites, err = querydb.UserInvites(uid)
+				if err != nil {
+					logger.Error().Err(err).Msg("")
+				}
+			}
+			identities, err := querydb.UserIdentities(uid)
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+			}
+			tokens, err := querydb.UserAPITokens(uid)
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+			}
+			restriction, err := writeRestriction(uid)
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+			}
+
+			html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/settings.html", "html/footer.html"))
+			html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "Settings", "Userinfo": userinfo, "Csrf": csrfToken(c)})
+			html.ExecuteTemplate(c.Writer, "html/settings.html", gin.H{"Userinfo": userinfo,
+				"Enroll_required": enrollmentRequired(userinfo),
+				"Restriction":     restriction,
+				"Can_invite":      can(userinfo.Role, capInviteCreate),
+				"Invites":         invites,
+				"Mail_enabled":    outbox != nil,
+				"Providers":       providerList,
+				"Identities":      identities,
+				"Tokens":          tokens,
+				"Scopes":          apiScopes})
 			html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 		} else if c.Request.Method == "POST" {
 			if c.Param("setting") == "pfp" {
@@ -476,7 +779,7 @@ func settings(c *gin.Context) {
 					return
 				}
 				if pfp.Size > 500000 {
-					html := template.Must(template.ParseFiles("html/htmx/form_feedback.html"))
+					html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
 					html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "File is to big"})
 					return
 				}
@@ -501,12 +804,12 @@ func settings(c *gin.Context) {
 					c.SaveUploadedFile(pfp, "html/user_pictures/"+filename)
 					querydb.SetPFP(uid, filename)
 				} else {
-					html := template.Must(template.ParseFiles("html/htmx/form_feedback.html"))
+					html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
 					html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "invalid file type"})
 					return
 				}
 
-				html := template.Must(template.ParseFiles("html/htmx/form_feedback.html"))
+				html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
 				html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "ok", "Message": "profile updated"})
 				return
 
@@ -517,26 +820,26 @@ func settings(c *gin.Context) {
 				bg = strings.Replace(bg, "#", "", 1)
 				if _, err := hex.DecodeString(fg); err != nil || len(fg) != 6 {
 					logger.Error().Err(err).Msg("")
-					html := template.Must(template.ParseFiles("html/htmx/form_feedback.html"))
+					html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
 					html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "invalid color format"})
 					return
 				}
 
 				if _, err := hex.DecodeString(bg); err != nil || len(bg) != 6 {
 					logger.Error().Err(err).Msg("")
-					html := template.Must(template.ParseFiles("html/htmx/form_feedback.html"))
+					html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
 					html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "invalid color format"})
 					return
 				}
 
 				if err := querydb.SetColor(uid, fg, bg); err != nil {
 					logger.Error().Err(err).Msg("")
-					html := template.Must(template.ParseFiles("html/htmx/form_feedback.html"))
+					html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
 					html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "error setting colors"})
 					return
 				}
 
-				html := template.Must(template.ParseFiles("html/htmx/form_feedback.html"))
+				html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
 				html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "ok", "Message": "set username colors"})
 				return
 
@@ -545,11 +848,11 @@ func settings(c *gin.Context) {
 				err := querydb.SetBio(uid, bio)
 				if err != nil {
 					logger.Error().Err(err).Msg("")
-					html := template.Must(template.ParseFiles("html/htmx/form_feedback.html"))
+					html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
 					html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "error updating bio"})
 					return
 				}
-				html := template.Must(template.ParseFiles("html/htmx/form_feedback.html"))
+				html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
 				html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "ok", "Message": "set bio"})
 				return
 			} else if c.Param("setting") == "theme" {
@@ -565,42 +868,66 @@ func settings(c *gin.Context) {
 
 				if _, err := hex.DecodeString(primary1); err != nil || len(primary1) != 6 {
 					logger.Error().Err(err).Msg("")
-					html := template.Must(template.ParseFiles("html/htmx/form_feedback.html"))
+					html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
 					html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "invalid color format"})
 					return
 				}
 
 				if _, err := hex.DecodeString(primary2); err != nil || len(primary2) != 6 {
 					logger.Error().Err(err).Msg("")
-					html := template.Must(template.ParseFiles("html/htmx/form_feedback.html"))
+					html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
 					html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "invalid color format"})
 					return
 				}
 
 				if _, err := hex.DecodeString(background1); err != nil || len(background1) != 6 {
 					logger.Error().Err(err).Msg("")
-					html := template.Must(template.ParseFiles("html/htmx/form_feedback.html"))
+					html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
 					html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "invalid color format"})
 					return
 				}
 
 				if _, err := hex.DecodeString(background2); err != nil || len(background2) != 6 {
 					logger.Error().Err(err).Msg("")
-					html := template.Must(template.ParseFiles("html/htmx/form_feedback.html"))
+					html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
 					html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "invalid color format"})
 					return
 				}
 
 				if err := querydb.SetTheme(uid, primary1, primary2, background1, background2); err != nil {
 					logger.Error().Err(err).Msg("")
-					html := template.Must(template.ParseFiles("html/htmx/form_feedback.html"))
+					html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
 					html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "error setting theme"})
 					return
 				}
 
-				html := template.Must(template.ParseFiles("html/htmx/form_feedback.html"))
+				html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
 				html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "ok", "Message": "set theme colors"})
 				return
+			} else if c.Param("setting") == "password" {
+				changePassword(uid, c)
+				return
+			} else if c.Param("setting") == "invite" {
+				newInvite(uid, c)
+				return
+			} else if c.Param("setting") == "totp-setup" {
+				totpSetup(uid, c)
+				return
+			} else if c.Param("setting") == "totp-confirm" {
+				totpConfirm(uid, c)
+				return
+			} else if c.Param("setting") == "totp-disable" {
+				totpDisable(uid, c)
+				return
+			} else if c.Param("setting") == "token" {
+				newAPIToken(uid, c)
+				return
+			} else if c.Param("setting") == "email" {
+				setEmail(uid, c)
+				return
+			} else if c.Param("setting") == "digest" {
+				setDigest(uid, c)
+				return
 			}
 		}
 	}
@@ -617,11 +944,21 @@ func editor(c *gin.Context) {
 			logger.Error().Err(err).Msg("")
 			return
 		}
+		// only publishing is checked, edits of published posts aren't
+		var spam *spamChallenge
+		challenged, err := postChallenged(userinfo)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if challenged {
+			spam = newChallenge("post")
+		}
 
 		if c.Param("id") == "" {
-			html := template.Must(template.ParseFiles("html/auth_header.html", "html/editor.html", "html/footer.html"))
-			html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "editor", "Userinfo": userinfo})
-			html.ExecuteTemplate(c.Writer, "html/editor.html", gin.H{"Categories": config.Categories})
+			html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/editor.html", "html/spam.html", "html/footer.html"))
+			html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "editor", "Userinfo": userinfo, "Csrf": csrfToken(c)})
+			html.ExecuteTemplate(c.Writer, "html/editor.html", gin.H{"Categories": visibleCategories(&userinfo, canPostIn), "Spam": spam})
 			html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 			return
 		} else {
@@ -638,16 +975,22 @@ func editor(c *gin.Context) {
 				return
 			}
 
-			if postinfo.Uid != uid {
+			if !canModify(userinfo, postinfo.Uid, capPostEditOwn, capPostEditAny) {
 				logger.Error().Err(errors.New("user tried to access unauthorized resource"))
 				return
 			}
 
 			postHTML := template.HTML(string(postinfo.Html))
+			if postinfo.Status != "draft" {
+				spam = nil
+			}
 
-			html := template.Must(template.ParseFiles("html/auth_header.html", "html/editor.html", "html/footer.html"))
-			html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "editor", "Userinfo": userinfo})
-			html.ExecuteTemplate(c.Writer, "html/editor.html", gin.H{"Postinfo": postinfo, "PostHTML": postHTML, "Categories": config.Categories})
+			html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/editor.html", "html/spam.html", "html/footer.html"))
+			html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "editor", "Userinfo": userinfo, "Csrf": csrfToken(c)})
+			html.ExecuteTemplate(c.Writer, "html/editor.html", gin.H{"Postinfo": postinfo,
+				"PostHTML":   postHTML,
+				"Categories": visibleCategories(&userinfo, canPostIn),
+				"Spam":       spam})
 			html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 			return
 		}
@@ -690,11 +1033,33 @@ func save(c *gin.Context) {
 			return
 		}
 
+		userinfo, err := querydb.Userinfo(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if restriction, err := writeRestriction(uid); err != nil || restriction != "" {
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+			c.JSON(403, gin.H{"error": restriction})
+			return
+		}
+
 		section, err := validateSection(post.Section)
 		if err != nil {
 			logger.Error().Err(err).Msg("")
 			return
 		}
+		if !canPostIn(section, &userinfo) {
+			c.JSON(403, gin.H{"error": "you can't post in this section"})
+			return
+		}
+		if refused := filterPost(&post); refused != "" {
+			c.JSON(403, gin.H{"error": refused})
+			return
+		}
 
 		//compile html
 		if err := md.Convert([]byte(post.Md), &buf); err != nil {
@@ -719,18 +1084,22 @@ func save(c *gin.Context) {
 				logger.Error().Err(err).Msg("")
 				return
 			}
-			poster, _, _, err := querydb.GetPostOP(int32(pid))
+			current, err := querydb.GetPost(int32(pid))
 			if err != nil {
 				logger.Error().Err(err).Msg("")
 				return
 			}
 
-			if poster != uid {
+			if !canModify(userinfo, current.Uid, capPostEditOwn, capPostEditAny) {
 				logger.Error().Err(errors.New("user tried to access unauthorized resource"))
 				return
 			}
+			if current.Status != "draft" && linksRefused(userinfo, post.Md) {
+				c.JSON(403, gin.H{"error": "new accounts can't post links"})
+				return
+			}
 
-			err = querydb.UpdatePost(int32(pid), post.Title, post.Md, buf.String(), section.Id)
+			err = querydb.UpdatePost(int32(pid), post.Title, post.Md, buf.String(), section.Id, modAction(uid, current.Uid, "post.edit", "post", int32(pid), ""))
 			if err != nil {
 				logger.Error().Err(err).Msg("")
 				return
@@ -749,56 +1118,140 @@ func post(c *gin.Context) {
 		var buf bytes.Buffer
 		var err error
 
-		if err := c.ShouldBindJSON(&post); err != nil {
+		// bound with the body kept so publish can read the spam check from it too
+		if err := c.ShouldBindBodyWith(&post, binding.JSON); err != nil {
 			logger.Error().Err(err).Msg("")
 			return
 		}
 
+		userinfo, err := querydb.Userinfo(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if verifiedEmailMissing(userinfo) {
+			c.JSON(403, gin.H{"error": "verify your email address before posting"})
+			return
+		}
+		if restriction, err := writeRestriction(uid); err != nil || restriction != "" {
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+			c.JSON(403, gin.H{"error": restriction})
+			return
+		}
+
 		section, err := validateSection(post.Section)
 		if err != nil {
 			logger.Error().Err(err).Msg("")
 			return
 		}
+		if !canPostIn(section, &userinfo) {
+			c.JSON(403, gin.H{"error": "you can't post in this section"})
+			return
+		}
+		if refused := filterPost(&post); refused != "" {
+			c.JSON(403, gin.H{"error": refused})
+			return
+		}
 
 		if err := md.Convert([]byte(post.Md), &buf); err != nil {
 			logger.Error().Err(err).Msg("")
 			return
 		}
+		// publish checks new posts and drafts, edits of published posts keep their status
+		publish := func() (string, bool) {
+			restriction, err := unrankedRestriction(userinfo, post.Md)
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return "", false
+			}
+			if restriction != "" {
+				c.JSON(403, gin.H{"error": restriction})
+				return "", false
+			}
+			challenged, err := postChallenged(userinfo)
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return "", false
+			}
+			if challenged {
+				// api clients have no editor page to get a challenge from
+				if _, api := session.Values["api_token"]; api {
+					c.JSON(403, gin.H{"error": "your first posts have to be made from the editor"})
+					return "", false
+				}
+				var answer spamAnswer
+				c.ShouldBindBodyWith(&answer, binding.JSON)
+				if failed := checkSpam("post", answer); failed != "" {
+					c.JSON(403, gin.H{"error": failed})
+					return "", false
+				}
+			}
+			status, err := publishStatus(userinfo)
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return "", false
+			}
+			return status, true
+		}
+
 		if c.Param("id") == "" {
-			pid, err := querydb.NewPost(uid, section.Id, "posted", post.Title, post.Md, buf.String())
+			status, ok := publish()
+			if !ok {
+				return
+			}
+			pid, err := querydb.NewPost(uid, section.Id, status, post.Title, post.Md, buf.String())
 			if err != nil {
 				logger.Error().Err(err).Msg("")
 				return
 			}
-			c.JSON(200, gin.H{"pid": pid, "section": section.Id, "title": post.Title})
+			c.JSON(200, gin.H{"pid": pid, "section": section.Id, "title": post.Title, "queued": status == "queued"})
 		} else {
 			pid, err := strconv.ParseInt(c.Param("id"), 10, 32)
 			if err != nil {
 				logger.Error().Err(err).Msg("")
 				return
 			}
-			poster, _, _, err := querydb.GetPostOP(int32(pid))
+			current, err := querydb.GetPost(int32(pid))
 			if err != nil {
 				logger.Error().Err(err).Msg("")
 				return
 			}
 
-			if poster != uid {
+			if !canModify(userinfo, current.Uid, capPostEditOwn, capPostEditAny) {
 				logger.Error().Err(errors.New("user tried to access unauthorized resource"))
 				return
 			}
 
-			err = querydb.UpdatePost(int32(pid), post.Title, post.Md, buf.String(), section.Id)
+			status := current.Status
+			if status == "draft" {
+				// publishing a draft is posting it, editing it isn't enough
+				if !can(userinfo.Role, capPostCreate) {
+					c.JSON(403, gin.H{"error": "you can't create posts"})
+					return
+				}
+				var ok bool
+				if status, ok = publish(); !ok {
+					return
+				}
+			} else if linksRefused(userinfo, post.Md) {
+				c.JSON(403, gin.H{"error": "new accounts can't post links"})
+				return
+			}
+
+			err = querydb.UpdatePost(int32(pid), post.Title, post.Md, buf.String(), section.Id, modAction(uid, current.Uid, "post.edit", "post", int32(pid), ""))
 			if err != nil {
 				logger.Error().Err(err).Msg("")
 				return
 			}
-			err = querydb.UpdatePostStatus(int32(pid), "posted")
+			err = querydb.UpdatePostStatus(int32(pid), status)
 			if err != nil {
 				logger.Error().Err(err).Msg("")
 				return
 			}
-			c.JSON(200, gin.H{"pid": pid, "section": section.Id, "title": post.Title})
+			c.JSON(200, gin.H{"pid": pid, "section": section.Id, "title": post.Title, "queued": status == "queued"})
 		}
 	}
 }
@@ -822,7 +1275,7 @@ func posts(c *gin.Context) {
 			return
 		}
 
-		posts, err := querydb.UserPosts(user_id, "posted")
+		posts, err := querydb.UserPosts(user_id, "posted", visibleSections(&userinfo))
 		if err != nil {
 			logger.Error().Err(err).Msg("")
 			return
@@ -834,8 +1287,8 @@ func posts(c *gin.Context) {
 			posts[i].Time_formatted = formattedTime(posts[i].Time_posted)
 		}
 
-		html := template.Must(template.ParseFiles("html/auth_header.html", "html/user-posts.html", "html/footer.html"))
-		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "posts", "Userinfo": userinfo})
+		html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/user-posts.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "posts", "Userinfo": userinfo, "Csrf": csrfToken(c)})
 		html.ExecuteTemplate(c.Writer, "html/user-posts.html", gin.H{"Posts": posts, "Status": "Posts"})
 		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 	}
@@ -858,7 +1311,7 @@ func drafts(c *gin.Context) {
 			return
 		}
 
-		posts, err := querydb.UserPosts(uid, "draft")
+		posts, err := querydb.UserPosts(uid, "draft", visibleSections(&userinfo))
 		if err != nil {
 			logger.Error().Err(err).Msg("")
 			return
@@ -870,8 +1323,8 @@ func drafts(c *gin.Context) {
 			posts[i].Time_formatted = formattedTime(posts[i].Time_posted)
 		}
 
-		html := template.Must(template.ParseFiles("html/auth_header.html", "html/user-posts.html", "html/footer.html"))
-		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "drafts", "Userinfo": userinfo})
+		html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/user-posts.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "drafts", "Userinfo": userinfo, "Csrf": csrfToken(c)})
 		html.ExecuteTemplate(c.Writer, "html/user-posts.html", gin.H{"Posts": posts, "Status": "Drafts"})
 		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 	}
@@ -887,6 +1340,10 @@ func section(c *gin.Context) {
 		logger.Error().Err(err).Msg("")
 		return
 	}
+	if !canRead(sectioninfo, viewer(uid)) {
+		c.AbortWithStatus(404)
+		return
+	}
 	if uid != -1 {
 		userinfo, err := querydb.Userinfo(uid)
 		if err != nil {
@@ -894,13 +1351,13 @@ func section(c *gin.Context) {
 			return
 		}
 
-		html := template.Must(template.ParseFiles("html/auth_header.html", "html/section.html", "html/footer.html"))
-		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": sectioninfo.Section, "Userinfo": userinfo})
+		html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/section.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": sectioninfo.Section, "Userinfo": userinfo, "Csrf": csrfToken(c)})
 		html.ExecuteTemplate(c.Writer, "html/section.html", gin.H{"Section": sectioninfo, "Logged_in": true})
 		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 	} else {
-		html := template.Must(template.ParseFiles("html/unauth_header.html", "html/section.html", "html/footer.html"))
-		html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": sectioninfo.Section, "Registration": config.Registration})
+		html := template.Must(newTemplate().ParseFiles("html/unauth_header.html", "html/section.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": sectioninfo.Section, "Registration": config.Registration, "Csrf": csrfToken(c)})
 		html.ExecuteTemplate(c.Writer, "html/section.html", gin.H{"Section": sectioninfo, "Logged_in": false})
 		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 	}
@@ -922,8 +1379,22 @@ func viewPost(c *gin.Context) {
 		logger.Error().Err(err).Msg("")
 		return
 	}
+	if !canReadPost(postinfo.Section, viewer(uid)) {
+		c.AbortWithStatus(404)
+		return
+	}
 	if postinfo.Status != "posted" {
 		index(c)
+		return
+	}
+	if c.Param("section") != postinfo.Section {
+		// the thread was moved, keep the query so a comment thread or sort survives
+		location := "/section/" + postinfo.Section + "/" + strconv.Itoa(int(postinfo.Pid)) + "/" + url.PathEscape(postinfo.Title)
+		if c.Request.URL.RawQuery != "" {
+			location += "?" + c.Request.URL.RawQuery
+		}
+		c.Redirect(301, location)
+		return
 	}
 
 	postinfo.Time_formatted = formattedTime(postinfo.Time_posted)
@@ -934,18 +1405,33 @@ func viewPost(c *gin.Context) {
 		return
 	}
 
-	comments, err := querydb.GetComments(postinfo.Pid)
+	comments, err := querydb.GetComments(postinfo.Pid, uid)
 	if err != nil {
 		logger.Error().Err(err).Msg("")
 		return
 	}
 	for i := 0; i < len(comments); i++ {
+		// placeholders don't show who wrote them
+		if comments[i].Status != "posted" {
+			continue
+		}
 		comments[i].User, err = querydb.GetUser(comments[i].User_id)
 		if err != nil {
 			logger.Error().Err(err).Msg("")
 			return
 		}
 	}
+	// ?thread= shows one comment and its replies, for threads nested past the max depth
+	var thread int64
+	if c.Query("thread") != "" {
+		thread, err = strconv.ParseInt(c.Query("thread"), 10, 32)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+	}
+	page := &commentPage{Postinfo: postinfo, Sort: commentSort(c)}
+	threads := buildThreads(comments, int32(thread), page.Sort, page)
 
 	if uid != -1 {
 
@@ -956,23 +1442,33 @@ func viewPost(c *gin.Context) {
 		}
 
 		liked, _ := querydb.Liked(uid, postinfo.Pid)
-		html := template.Must(template.ParseFiles("html/auth_header.html", "html/post.html", "html/footer.html"))
-		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": postinfo.Title, "Userinfo": userinfo})
+		page.Logged_in = true
+		page.Userinfo = userinfo
+		html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/post.html", "html/comment.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": postinfo.Title, "Userinfo": userinfo, "Csrf": csrfToken(c)})
 		html.ExecuteTemplate(c.Writer, "html/post.html", gin.H{"Postinfo": postinfo,
-			"Comments":  comments,
-			"Liked":     liked,
-			"Logged_in": true,
-			"Editable":  postinfo.Uid == uid})
+			"Comments":   threads,
+			"Sort":       page.Sort,
+			"Thread":     thread,
+			"Liked":      liked,
+			"Logged_in":  true,
+			"Userinfo":   userinfo,
+			"Categories": config.Categories,
+			"Editable":   canModify(userinfo, postinfo.Uid, capPostEditOwn, capPostEditAny),
+			"Deletable":  canModify(userinfo, postinfo.Uid, capPostDeleteOwn, capPostDeleteAny)})
 		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 
 	} else {
-		html := template.Must(template.ParseFiles("html/unauth_header.html", "html/post.html", "html/footer.html"))
-		html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": postinfo.Title, "Registration": config.Registration})
+		html := template.Must(newTemplate().ParseFiles("html/unauth_header.html", "html/post.html", "html/comment.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": postinfo.Title, "Registration": config.Registration, "Csrf": csrfToken(c)})
 		html.ExecuteTemplate(c.Writer, "html/post.html", gin.H{"Postinfo": postinfo,
-			"Comments":  comments,
+			"Comments":  threads,
+			"Sort":      page.Sort,
+			"Thread":    thread,
 			"Liked":     false,
 			"Logged_in": false,
-			"Editable":  postinfo.Uid == uid})
+			"Editable":  false,
+			"Deletable": false})
 		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 	}
 }
@@ -999,8 +1495,19 @@ func reply(c *gin.Context) {
 			}
 		}
 
+		postinfo, err := querydb.GetPost(int32(pid))
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if postinfo.Locked {
+			html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+			html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "this thread is locked"})
+			return
+		}
+
 		if c.Request.Method == "GET" {
-			html := template.Must(template.ParseFiles("html/htmx/reply.html"))
+			html := template.Must(newTemplate().ParseFiles("html/htmx/reply.html"))
 			html.ExecuteTemplate(c.Writer, "html/htmx/reply.html", gin.H{"Pid": pid, "Cid": cid})
 			return
 
@@ -1013,57 +1520,86 @@ func reply(c *gin.Context) {
 				return
 			}
 
-			OP, section, title, err := querydb.GetPostOP(int32(pid))
+			userinfo, err := querydb.Userinfo(uid)
 			if err != nil {
 				logger.Error().Err(err).Msg("")
 				return
 			}
-			if cid == 0 {
-
-				if err := md.Convert([]byte(comment), &buf); err != nil {
-					logger.Error().Err(err).Msg("")
-					return
-				}
-
-				_, err = querydb.PostComment(uid, int32(pid), -1, comment, buf.String())
+			if verifiedEmailMissing(userinfo) {
+				html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+				html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "verify your email address before commenting"})
+				return
+			}
+			if restriction, err := writeRestriction(uid); err != nil || restriction != "" {
 				if err != nil {
 					logger.Error().Err(err).Msg("")
 					return
 				}
-				if OP != uid {
-					err = querydb.NewNotification(OP, uid, fmt.Sprintf(`Left a comment on your post <a href="/section/%s/%d/%s">%s</a>`, section, pid, title, title))
-					if err != nil {
-						logger.Error().Err(err).Msg("")
-						return
-					}
-				}
+				html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+				html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": restriction})
+				return
+			}
 
-			} else if cid != 0 {
-				if err := md.Convert([]byte(comment), &buf); err != nil {
-					logger.Error().Err(err).Msg("")
-					return
-				}
+			OP, section, title, err := querydb.GetPostOP(int32(pid))
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+			if !canReplyIn(Sections[section], &userinfo) {
+				html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+				html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "you can't comment in this section"})
+				return
+			}
+			restriction, err := unrankedRestriction(userinfo, comment)
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+			if restriction != "" {
+				html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+				html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": restriction})
+				return
+			}
+			comment, refused := applyPolicy(comment)
+			if refused != "" {
+				html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+				html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": refused})
+				return
+			}
+			if err := md.Convert([]byte(comment), &buf); err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
 
-				_, err = querydb.PostComment(uid, int32(pid), int32(cid), comment, buf.String())
-				if err != nil {
-					logger.Error().Err(err).Msg("")
-					return
-				}
+			new_cid, err := querydb.PostComment(uid, int32(pid), int32(cid), comment, buf.String())
+			if err == querydb.ErrInvalidParent {
+				html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+				html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": err.Error()})
+				return
+			} else if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
 
-				comment_poster, err := querydb.GetCommentPoster(int32(cid))
-				if err != nil {
-					logger.Error().Err(err).Msg("")
-					return
+			// a comment notifies the author of what it replies to, the post or the parent comment
+			link := fmt.Sprintf(`<a href="/section/%s/%d/%s#comment-%d">%s</a>`, section, pid, url.PathEscape(title), new_cid, template.HTMLEscapeString(title))
+			if cid == 0 {
+				if OP != uid {
+					err = querydb.NewPostNotification(OP, uid, int32(pid), new_cid, "Left a comment on your post "+link)
 				}
-
-				if comment_poster != uid {
-					err = querydb.NewNotification(comment_poster, uid, fmt.Sprintf(`Responsed to your comment on <a href="/section/%s/%d/%s">%s</a>`, section, pid, title, title))
-					if err != nil {
-						logger.Error().Err(err).Msg("")
-						return
-					}
+			} else {
+				// linked to the parent's thread since the reply may be nested too deep to show on the post
+				link = fmt.Sprintf(`<a href="/section/%s/%d/%s?thread=%d">%s</a>`, section, pid, url.PathEscape(title), cid, template.HTMLEscapeString(title))
+				var comment_poster int32
+				comment_poster, err = querydb.GetCommentPoster(int32(cid))
+				if err == nil && comment_poster != uid {
+					err = querydb.NewPostNotification(comment_poster, uid, int32(pid), new_cid, "Replied to your comment on "+link)
 				}
 			}
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
 			c.Header("HX-Refresh", "true")
 		}
 	}
@@ -1080,6 +1616,23 @@ func like(c *gin.Context) {
 			logger.Error().Err(err).Msg("")
 			return
 		}
+		_, section, _, err := querydb.GetPostOP(int32(pid))
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if !canReadPost(section, viewer(uid)) {
+			c.AbortWithStatus(404)
+			return
+		}
+		if restriction, err := writeRestriction(uid); err != nil || restriction != "" {
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+			c.JSON(403, gin.H{"error": restriction})
+			return
+		}
 		err = querydb.LikeUnlike(uid, int32(pid))
 		if err != nil {
 			logger.Error().Err(err).Msg("")
@@ -1099,7 +1652,7 @@ func likes(c *gin.Context) {
 			return
 		}
 
-		posts, err := querydb.Likes(uid)
+		posts, err := querydb.Likes(uid, visibleSections(&userinfo))
 		if err != nil {
 			logger.Error().Err(err).Msg("")
 			return
@@ -1114,8 +1667,8 @@ func likes(c *gin.Context) {
 			posts[i].Time_formatted = formattedTime(posts[i].Time_posted)
 		}
 
-		html := template.Must(template.ParseFiles("html/auth_header.html", "html/user-posts.html", "html/footer.html"))
-		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "likes", "Userinfo": userinfo})
+		html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/user-posts.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "likes", "Userinfo": userinfo, "Csrf": csrfToken(c)})
 		html.ExecuteTemplate(c.Writer, "html/user-posts.html", gin.H{"Status": "likes", "Posts": posts})
 		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 	}
@@ -1145,8 +1698,8 @@ func notifications(c *gin.Context) {
 				return
 			}
 		}
-		html := template.Must(template.ParseFiles("html/auth_header.html", "html/notifications.html", "html/footer.html"))
-		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "notifications", "Userinfo": userinfo})
+		html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/notifications.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "notifications", "Userinfo": userinfo, "Csrf": csrfToken(c)})
 		html.ExecuteTemplate(c.Writer, "html/notifications.html", gin.H{"Notifications": notifications})
 		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 	}
@@ -1166,20 +1719,20 @@ func search(c *gin.Context) {
 				logger.Error().Err(err).Msg("")
 				return
 			}
-			html := template.Must(template.ParseFiles("html/auth_header.html", "html/search.html", "html/footer.html"))
-			html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "search", "Userinfo": userinfo})
+			html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/search.html", "html/footer.html"))
+			html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "search", "Userinfo": userinfo, "Csrf": csrfToken(c)})
 			html.ExecuteTemplate(c.Writer, "html/search.html", nil)
 			html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 			return
 		} else {
-			html := template.Must(template.ParseFiles("html/unauth_header.html", "html/search.html", "html/footer.html"))
-			html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "search", "Registration": config.Registration})
+			html := template.Must(newTemplate().ParseFiles("html/unauth_header.html", "html/search.html", "html/footer.html"))
+			html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "search", "Registration": config.Registration, "Csrf": csrfToken(c)})
 			html.ExecuteTemplate(c.Writer, "html/search.html", nil)
 			html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
 			return
 		}
 	} else if qry != "" {
-		posts, err := querydb.Search(qry)
+		posts, err := querydb.Search(qry, visibleSections(viewer(uid)))
 		if err != nil {
 			logger.Error().Err(err).Msg("")
 			return
@@ -1195,7 +1748,7 @@ func search(c *gin.Context) {
 			posts[i].Time_formatted = formattedTime(posts[i].Time_posted)
 		}
 
-		html := template.Must(template.ParseFiles("html/htmx/results.html"))
+		html := template.Must(newTemplate().ParseFiles("html/htmx/results.html"))
 		html.ExecuteTemplate(c.Writer, "html/htmx/results.html", gin.H{"Posts": posts})
 	}
 }
@@ -1211,7 +1764,7 @@ func deletePost(c *gin.Context) {
 			return
 		}
 
-		userlisted, err := querydb.GetUser(uid)
+		userinfo, err := querydb.Userinfo(uid)
 		if err != nil {
 			logger.Error().Err(err).Msg("")
 			return
@@ -1223,8 +1776,13 @@ func deletePost(c *gin.Context) {
 			return
 		}
 
-		if postop == uid {
-			err = querydb.DeletePost(int32(pid))
+		if canModify(userinfo, postop, capPostDeleteOwn, capPostDeleteAny) {
+			userlisted, err := querydb.GetUser(postop)
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+			err = querydb.DeletePost(int32(pid), uid, modAction(uid, postop, "post.delete", "post", int32(pid), modReason(c)))
 			if err != nil {
 				logger.Error().Err(err).Msg("")
 				return
@@ -1250,13 +1808,19 @@ func deleteReply(c *gin.Context) {
 			return
 		}
 
+		userinfo, err := querydb.Userinfo(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+
 		commentPost, err := querydb.GetCommentPoster(int32(cid))
 		if err != nil {
 			logger.Error().Err(err).Msg("")
 			return
 		}
-		if commentPost == uid {
-			err = querydb.DeleteReply(int32(cid))
+		if canModify(userinfo, commentPost, capCommentDeleteOwn, capCommentDeleteAny) {
+			err = querydb.DeleteReply(int32(cid), uid, modAction(uid, commentPost, "comment.delete", "comment", int32(cid), modReason(c)))
 			if err != nil {
 				logger.Error().Err(err).Msg("")
 				return
@@ -1266,11 +1830,19 @@ func deleteReply(c *gin.Context) {
 }
 
 func mostLiked(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+
 	section, err := validateSection(c.Param("section"))
 	if err != nil {
 		logger.Error().Err(err).Msg("")
 		return
 	}
+	if !canRead(section, viewer(uid)) {
+		c.AbortWithStatus(404)
+		return
+	}
 
 	posts, err := querydb.MostLiked(section)
 	if err != nil {
@@ -1287,16 +1859,24 @@ func mostLiked(c *gin.Context) {
 		posts[i].Time_formatted = formattedTime(posts[i].Time_posted)
 	}
 
-	html := template.Must(template.ParseFiles("html/htmx/results.html"))
+	html := template.Must(newTemplate().ParseFiles("html/htmx/results.html"))
 	html.ExecuteTemplate(c.Writer, "html/htmx/results.html", gin.H{"Posts": posts, "Section": section.Id})
 }
 
 func newest(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+
 	section, err := validateSection(c.Param("section"))
 	if err != nil {
 		logger.Error().Err(err).Msg("")
 		return
 	}
+	if !canRead(section, viewer(uid)) {
+		c.AbortWithStatus(404)
+		return
+	}
 
 	posts, err := querydb.GetSectionPosts(section.Id)
 	if err != nil {
@@ -1313,7 +1893,7 @@ func newest(c *gin.Context) {
 		posts[i].Time_formatted = formattedTime(posts[i].Time_posted)
 	}
 
-	html := template.Must(template.ParseFiles("html/htmx/results.html"))
+	html := template.Must(newTemplate().ParseFiles("html/htmx/results.html"))
 	html.ExecuteTemplate(c.Writer, "html/htmx/results.html", gin.H{"Posts": posts, "Section": section.Id})
 }
 
@@ -1330,6 +1910,10 @@ func rawMD(c *gin.Context) {
 		if err != nil {
 			return
 		}
+		if !canReadPost(postinfo.Section, viewer(uid)) {
+			c.AbortWithStatus(404)
+			return
+		}
 
 		userinfo, _ := querydb.Userinfo(postinfo.Uid)
 
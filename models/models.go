@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"html/template"
 	"time"
 )
@@ -21,6 +22,11 @@ type User struct {
 	Theme          Theme
 	Date_Joined    time.Time
 	Date_formatted string
+	Totp_enabled   bool
+	Status         string
+	Email          string
+	Email_verified bool
+	Email_digest   bool
 }
 
 type Userlisted struct {
@@ -41,6 +47,8 @@ type Post struct {
 	Html           template.HTML `json:"html"`
 	Time_posted    time.Time     `json:"time_posted"`
 	Time_formatted string        `json:"time_formatted"`
+	Locked         bool          `json:"locked"`
+	Pinned         bool          `json:"pinned"`
 }
 
 type PostListing struct {
@@ -52,17 +60,36 @@ type PostListing struct {
 	Section        string     `json:"section"`
 	Time_posted    time.Time  `json:"time_posted"`
 	Time_formatted string     `json:"time_formatted"`
+	Pinned         bool       `json:"pinned"`
 }
 
 type Comment struct {
-	Cid          int32         `json:"Cid"`
-	Parent_post  int32         `json:"Parent"`
-	Comment_post int32         `json:"Comment"`
-	User_id      int32         `json:"uid"`
-	User         Userlisted    `json:"user"`
-	Md           string        `json:"md"`
-	Html         template.HTML `json:"html"`
-	Time_posted  time.Time     `json:"time_posted"`
+	Cid         int32 `json:"Cid"`
+	Parent_post int32 `json:"Parent"`
+	// the comment this replies to, nil for a comment on the post itself
+	Parent_comment *int32        `json:"Parent_comment"`
+	User_id        int32         `json:"uid"`
+	User           Userlisted    `json:"user"`
+	Md             string        `json:"md"`
+	Html           template.HTML `json:"html"`
+	Time_posted    time.Time     `json:"time_posted"`
+	Status         string        `json:"status"`
+	Likes          int           `json:"likes"`
+	// whether the viewer liked it
+	Liked bool `json:"liked"`
+	// when it was last edited, nil if never
+	Edited *time.Time `json:"edited"`
+}
+
+// CommentRevision is one version of an edited comment
+type CommentRevision struct {
+	Id      int32
+	Comment int32
+	Editor  int32
+	User    Userlisted
+	Md      string
+	Html    template.HTML
+	Created time.Time
 }
 
 type Notification struct {
@@ -73,9 +100,29 @@ type Notification struct {
 	Message          template.HTML
 }
 
+type Invite struct {
+	Id         int32
+	Created_by int32
+	Max_uses   int32
+	Uses       int32
+	Created    time.Time
+	Expires    time.Time
+}
+
+type Identity struct {
+	Provider string
+	Subject  string
+	Linked   time.Time
+}
+
 type Section struct {
 	Section string
 	Id      string
+	// who can read the section, start threads in it and reply to them. Entries
+	// are roles or "group:<name>", an empty list allows everyone.
+	Read  []string
+	Post  []string
+	Reply []string
 }
 
 type Category struct {
@@ -84,9 +131,325 @@ type Category struct {
 }
 
 type Config struct {
+	// "open", "invite", "approval" or "closed"
 	Registration string
 	Theme        Theme
 	Categories   []Category
+	Argon2       Argon2Params
+	Sessions     SessionConfig
+	// ips or cidr ranges of reverse proxies whose X-Forwarded-For and X-Real-Ip headers are trusted
+	Trusted_proxies []string
+	Two_factor      TwoFactorConfig
+	Throttle        ThrottleConfig
+	Mail            MailConfig
+	// accounts need a verified email before they can post or reply
+	Require_verified_email bool
+	// OpenID Connect providers users can sign in with
+	Oidc []OIDCProvider
+	// role to capabilities, roles left out keep their defaults
+	Roles map[string][]string
+	// named lists of usernames sections can grant access to
+	Groups map[string][]string
+	// when unranked users are promoted to ranked
+	Promotion PromotionConfig
+	// limits on unranked users until they are promoted
+	Unranked UnrankedConfig
+	Reports  ReportConfig
+	// how long deleted posts and comments are kept
+	Trash TrashConfig
+	// proof of work and honeypot checks against bots
+	Spam SpamConfig
+	// word filter and link rules for posts and comments, reloaded on SIGHUP
+	Policy PolicyConfig
+	// how fast users can post, reply and like
+	Rate_limits RateLimitConfig
+	Comments    CommentConfig
+}
+
+type CommentConfig struct {
+	// how deep replies are nested before the rest of a thread moves behind a link, 0 for 6
+	Max_depth int
+	// "oldest", "newest" or "liked", empty for oldest
+	Sort string
+}
+
+type RateLimitConfig struct {
+	// limits per role and action ("post", "reply" or "like"), roles and actions that are left out keep their defaults
+	Roles map[string]map[string]RateLimit
+	// limits per ip address and action, shared by every account behind it
+	Ip map[string]RateLimit
+}
+
+type RateLimit struct {
+	// how many requests can be made in a row, 0 for no limit
+	Burst int
+	// go duration string for how long it takes to earn back one request
+	Every string
+}
+
+type PolicyConfig struct {
+	// words and phrases that get a post or comment refused, matched as whole words ignoring case
+	Blocked []string
+	// words and phrases that are censored, mapped to what replaces them, "" replaces them with asterisks
+	Replaced map[string]string
+	// checked in order after Blocked and Replaced
+	Rules []PolicyRule
+	Links LinkPolicy
+}
+
+type PolicyRule struct {
+	// go regular expression matched against the markdown
+	Pattern string
+	// "block" refuses matching content, "replace" replaces matches with Replacement
+	Action      string
+	Replacement string
+	// shown when a block rule refuses something
+	Message string
+}
+
+type LinkPolicy struct {
+	// when set links can only point to these domains and their subdomains
+	Allowed_domains []string
+	// links to these domains and their subdomains are refused
+	Denied_domains []string
+	// rel attribute added to links, empty for "nofollow ugc noopener"
+	Rel string
+}
+
+type SpamConfig struct {
+	// check registrations
+	Registration bool
+	// check this many of a user's first posts, 0 never checks posts
+	First_posts int
+	// leading zero bits a proof of work needs with no recent spam, and the most it
+	// can grow to as failed checks and spam reports come in
+	Min_difficulty int
+	Max_difficulty int
+	// go duration strings for how long a challenge can be solved in and how far
+	// back failures and spam reports count towards the difficulty
+	Challenge_lifetime string
+	Window             string
+}
+
+type TrashConfig struct {
+	// go duration string for how long users can restore what they deleted, empty for until it is purged
+	Restore_window string
+	// go duration string for how long deleted content is kept, empty keeps it forever
+	Retention string
+	// "delete" removes purged content, "anonymize" keeps the rows with the text cleared
+	Purge string
+}
+
+type ReportConfig struct {
+	// open reports from users above unranked that hide a post or comment until a mod
+	// resolves them, 0 never hides
+	Hide_after int
+}
+
+type PromotionConfig struct {
+	// go duration string for how often users are checked, empty disables promotion
+	Interval string
+	// go duration string for how old an account must be
+	Min_age      string
+	Min_posts    int
+	Min_comments int
+	// likes received from other users
+	Min_likes int
+}
+
+type UnrankedConfig struct {
+	// go duration string for the time between posts and comments, empty for no limit
+	Post_interval string
+	// refuse posts and comments that contain links
+	No_links bool
+	// how many of a user's first posts wait for a moderator to approve them
+	Queued_posts int
+}
+
+type OIDCProvider struct {
+	// used in urls and the client secret env variable, lowercase letters, digits and _
+	Name         string
+	Display_name string
+	Issuer       string
+	Client_id    string
+	// must be registered with the provider, it ends in /login/oidc/<Name>/callback
+	Redirect_url string
+	// requested on top of openid, email and profile
+	Scopes []string
+	// create an account for users that sign in without a linked account
+	Auto_provision bool
+}
+
+type MailConfig struct {
+	// "smtp", "file", "log" or empty to disable mail
+	Backend string
+	From    string
+	// used to build links in outgoing mail, e.g. https://forum.example.com
+	Base_url      string
+	Smtp_host     string
+	Smtp_port     int
+	Smtp_username string
+	// use implicit TLS instead of STARTTLS
+	Smtp_tls bool
+	// file the file backend appends to
+	File string
+}
+
+type ThrottleConfig struct {
+	// "memory" or "postgres", postgres shares lockouts between instances
+	Backend string
+	// go duration strings
+	Window      string
+	Lockout     string
+	Max_lockout string
+	// failed logins allowed within the window before a lockout
+	Ip_max_failures      int
+	Account_max_failures int
+}
+
+type TwoFactorConfig struct {
+	Issuer string
+	// roles that must enroll in two factor authentication before using the site
+	Required_roles []string
+}
+
+// timeouts are go duration strings such as "30m" or "720h", empty disables the timeout
+type SessionConfig struct {
+	Idle_timeout     string
+	Absolute_timeout string
+}
+
+type Session struct {
+	Id         int32
+	Uid        int32
+	Ip         string
+	User_agent string
+	Created    time.Time
+	Last_seen  time.Time
+	Current    bool
+}
+
+type Sanction struct {
+	Id  int32
+	Uid int32
+	// the sanctioned user, only set by ActiveSanctions
+	Username Username
+	// "mute", "suspend" or "ban"
+	Kind       string
+	Reason     string
+	Created_by Username
+	Created    time.Time
+	Expires    *time.Time
+	Lifted     *time.Time
+	Active     bool
+}
+
+type Report struct {
+	Id          int32
+	Reporter    Username
+	Target_type string
+	Target_id   int32
+	// "spam", "abuse", "off_topic" or "other"
+	Category string
+	Note     string
+	Created  time.Time
+}
+
+// ReportedContent is a post or comment in the report queue
+type ReportedContent struct {
+	// "post" or "comment"
+	Target_type    string
+	Target_id      int32
+	Author         int32
+	Author_listing Userlisted
+	// the post the content is on and its section and title, for links
+	Pid     int32
+	Section string
+	Title   string
+	Md      string
+	Status  string
+	Reports []Report
+}
+
+// ModAction is one entry in the moderation audit log
+type ModAction struct {
+	Id         int32    `json:"id"`
+	Actor      int32    `json:"actor"`
+	Actor_name Username `json:"actor_name"`
+	// e.g. "post.delete" or "user.ban"
+	Action string `json:"action"`
+	// "post", "comment" or "user"
+	Target_type string `json:"target_type"`
+	Target_id   int32  `json:"target_id"`
+	Reason      string `json:"reason"`
+	// the target before and after the change
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+	Time   time.Time       `json:"time"`
+}
+
+// UserSummary is a user as staff see them in the dashboard
+type UserSummary struct {
+	Id          int32
+	Username    Username
+	Role        string
+	Status      string
+	Date_joined time.Time
+}
+
+// ContentListing is a post or comment in the dashboard whatever its status
+type ContentListing struct {
+	// "post" or "comment"
+	Target_type string
+	Id          int32
+	Poster      int32
+	Author      Userlisted
+	// the post the content is on and its section and title, for links
+	Pid         int32
+	Section     string
+	Title       string
+	Status      string
+	Time_posted time.Time
+	// only set by the trash listings
+	Deleted    *time.Time
+	Deleted_by Username
+}
+
+type SiteStats struct {
+	Users          int
+	Pending_users  int
+	Posts          int
+	Comments       int
+	Likes          int
+	Posts_today    int
+	Comments_today int
+	Open_reports   int
+	Sanctioned     int
+}
+
+type ModActionFilter struct {
+	Actor       Username
+	Action      string
+	Target_type string
+	Target_id   int32
+	Since       time.Time
+	Until       time.Time
+}
+
+type APIToken struct {
+	Id        int32
+	Uid       int32
+	Name      string
+	Scopes    []string
+	Created   time.Time
+	Last_used *time.Time
+	Expires   *time.Time
+}
+
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
 }
 
 type Theme struct {
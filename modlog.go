@@ -0,0 +1,109 @@
+package main
+
+import (
+	"html/template"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/0sm1les/gopherbb/models"
+	"github.com/0sm1les/gopherbb/querydb"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	modLogPageSize   = 200
+	modLogExportSize = 10000
+)
+
+// modAction is the audit entry for uid changing content owned by owner_uid,
+// nil when users edit or delete their own content. Routes that need a mod
+// capability build their entry directly so they are logged whoever owns it.
+func modAction(uid int32, owner_uid int32, action string, target_type string, target_id int32, reason string) *models.ModAction {
+	if uid == owner_uid {
+		return nil
+	}
+	return &models.ModAction{Actor: uid, Action: action, Target_type: target_type, Target_id: target_id, Reason: reason}
+}
+
+// modReason is the reason a mod typed into an hx-prompt
+func modReason(c *gin.Context) string {
+	reason := strings.TrimSpace(c.GetHeader("HX-Prompt"))
+	for utf8.RuneCountInString(reason) > 255 {
+		_, size := utf8.DecodeLastRuneInString(reason)
+		reason = reason[:len(reason)-size]
+	}
+	return reason
+}
+
+func modLogFilter(c *gin.Context) models.ModActionFilter {
+	filter := models.ModActionFilter{
+		Actor:       models.Username(c.Query("actor")),
+		Action:      c.Query("action"),
+		Target_type: c.Query("target"),
+	}
+	if id, err := strconv.ParseInt(c.Query("target_id"), 10, 32); err == nil {
+		filter.Target_id = int32(id)
+	}
+	if since, err := time.Parse("2006-01-02", c.Query("since")); err == nil {
+		filter.Since = since
+	}
+	if until, err := time.Parse("2006-01-02", c.Query("until")); err == nil {
+		// include the whole day
+		filter.Until = until.AddDate(0, 0, 1)
+	}
+	return filter
+}
+
+// modLog is the admin page listing moderation actions
+func modLog(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		userinfo, err := querydb.Userinfo(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		actions, err := querydb.ModActions(modLogFilter(c), modLogPageSize)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+
+		html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/modlog.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "moderation log", "Userinfo": userinfo, "Csrf": csrfToken(c)})
+		html.ExecuteTemplate(c.Writer, "html/modlog.html", gin.H{"Actions": actions,
+			"Export":    template.URL("/admin/modlog/export?" + c.Request.URL.Query().Encode()),
+			"Actor":     c.Query("actor"),
+			"Action":    c.Query("action"),
+			"Target":    c.Query("target"),
+			"Target_id": c.Query("target_id"),
+			"Since":     c.Query("since"),
+			"Until":     c.Query("until")})
+		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
+	}
+}
+
+// exportModLog downloads the filtered log as json
+func exportModLog(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		actions, err := querydb.ModActions(modLogFilter(c), modLogExportSize)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			c.AbortWithStatus(500)
+			return
+		}
+		if actions == nil {
+			actions = []models.ModAction{}
+		}
+		c.Header("Content-Disposition", "attachment; filename=modlog-"+time.Now().Format("2006-01-02")+".json")
+		c.JSON(200, actions)
+	}
+}
@@ -0,0 +1,272 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// allowed difference between our clock and the provider's
+const clockSkew = time.Minute
+
+// Claims are the ID token claims gopherbb uses
+type Claims struct {
+	Issuer             string   `json:"iss"`
+	Subject            string   `json:"sub"`
+	Audience           audience `json:"aud"`
+	Authorized_party   string   `json:"azp"`
+	Expires            int64    `json:"exp"`
+	Issued             int64    `json:"iat"`
+	Nonce              string   `json:"nonce"`
+	Email              string   `json:"email"`
+	Email_verified     boolish  `json:"email_verified"`
+	Preferred_username string   `json:"preferred_username"`
+}
+
+// aud is either a string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+// some providers send email_verified as the string "true"
+type boolish bool
+
+func (v *boolish) UnmarshalJSON(b []byte) error {
+	switch string(b) {
+	case "true", `"true"`:
+		*v = true
+	default:
+		*v = false
+	}
+	return nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// verify checks the signature and claims of an ID token
+func (p *Provider) verify(token string, issuer string, nonce string, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, errors.New("malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Claims{}, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, errors.New("malformed id token signature")
+	}
+
+	key, err := p.key(header.Kid, header.Alg)
+	if err != nil {
+		return Claims{}, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	// the algorithm has to agree with the key type so an RSA key can't be used as an HMAC secret
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return Claims{}, fmt.Errorf("unsupported id token algorithm %q", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return Claims{}, errors.New("invalid id token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return Claims{}, fmt.Errorf("unsupported id token algorithm %q", header.Alg)
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return Claims{}, errors.New("invalid id token signature")
+		}
+	default:
+		return Claims{}, errors.New("unsupported signing key")
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Claims{}, err
+	}
+
+	// OpenID Connect Core 3.1.3.7
+	if claims.Issuer != issuer {
+		return Claims{}, errors.New("id token has the wrong issuer")
+	}
+	found := false
+	for _, aud := range claims.Audience {
+		if aud == p.Client_id {
+			found = true
+		}
+	}
+	if !found {
+		return Claims{}, errors.New("id token is not meant for this client")
+	}
+	if len(claims.Audience) > 1 && claims.Authorized_party != p.Client_id {
+		return Claims{}, errors.New("id token has the wrong authorized party")
+	}
+	if claims.Expires == 0 || now.After(time.Unix(claims.Expires, 0).Add(clockSkew)) {
+		return Claims{}, errors.New("id token has expired")
+	}
+	if claims.Issued != 0 && time.Unix(claims.Issued, 0).After(now.Add(clockSkew)) {
+		return Claims{}, errors.New("id token was issued in the future")
+	}
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return Claims{}, errors.New("id token nonce does not match")
+	}
+	if claims.Subject == "" {
+		return Claims{}, errors.New("id token has no subject")
+	}
+	return claims, nil
+}
+
+// key returns the signing key for kid, refetching the jwks when the provider
+// has rotated to a key we haven't seen
+func (p *Provider) key(kid string, alg string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key := p.lookup(kid, alg); key != nil {
+		return key, nil
+	}
+	if time.Since(p.keys_fetched) < jwksRefetch {
+		return nil, errors.New("unknown id token signing key")
+	}
+	if p.meta == nil {
+		return nil, errors.New("provider has not been discovered")
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	p.keys_fetched = time.Now()
+	if err := p.getJSON(p.meta.Jwks_uri, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	p.keys = keys
+
+	if key := p.lookup(kid, alg); key != nil {
+		return key, nil
+	}
+	return nil, errors.New("unknown id token signing key")
+}
+
+func (p *Provider) lookup(kid string, alg string) crypto.PublicKey {
+	if key, ok := p.keys[kid]; ok {
+		return key
+	}
+	// a token without a kid is fine as long as only one key could have signed it
+	if kid == "" {
+		var match crypto.PublicKey
+		for _, key := range p.keys {
+			_, is_rsa := key.(*rsa.PublicKey)
+			if is_rsa == (alg == "RS256") {
+				if match != nil {
+					return nil
+				}
+				match = key
+			}
+		}
+		return match
+	}
+	return nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid rsa exponent")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}
+		if key.N.BitLen() < 2048 {
+			return nil, errors.New("rsa key is too small")
+		}
+		return key, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, errors.New("unsupported curve")
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("ec point is not on the curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("malformed id token")
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.New("malformed id token")
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+// Package oidc implements the OpenID Connect authorization code flow with
+// PKCE for signing in through an external identity provider.
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0sm1les/gopherbb/models"
+)
+
+const (
+	// how long discovery metadata is trusted before it is fetched again
+	metadataLifetime = time.Hour
+	// unknown key ids trigger a jwks refetch at most this often
+	jwksRefetch = time.Minute
+	// response bodies from the provider are never read past this
+	maxBody = 1 << 20
+)
+
+var validName = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+type metadata struct {
+	Issuer                 string `json:"issuer"`
+	Authorization_endpoint string `json:"authorization_endpoint"`
+	Token_endpoint         string `json:"token_endpoint"`
+	Jwks_uri               string `json:"jwks_uri"`
+}
+
+type Provider struct {
+	models.OIDCProvider
+	secret string
+	client *http.Client
+
+	mu           sync.Mutex
+	meta         *metadata
+	meta_fetched time.Time
+	keys         map[string]crypto.PublicKey
+	keys_fetched time.Time
+}
+
+// New checks conf and returns a provider. Discovery is done on first use so
+// an unreachable provider doesn't stop the forum from starting.
+func New(conf models.OIDCProvider, secret string) (*Provider, error) {
+	if !validName.MatchString(conf.Name) {
+		return nil, fmt.Errorf("invalid oidc provider name %q", conf.Name)
+	}
+	if conf.Issuer == "" || conf.Client_id == "" || conf.Redirect_url == "" {
+		return nil, fmt.Errorf("oidc provider %s needs Issuer, Client_id and Redirect_url", conf.Name)
+	}
+	if conf.Display_name == "" {
+		conf.Display_name = conf.Name
+	}
+	return &Provider{
+		OIDCProvider: conf,
+		secret:       secret,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// NewVerifier returns a random PKCE code verifier
+func NewVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthURL returns the url that starts a login at the provider
+func (p *Provider) AuthURL(state string, nonce string, verifier string) (string, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	scopes := append([]string{"openid", "email", "profile"}, p.Scopes...)
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.Client_id)
+	v.Set("redirect_uri", p.Redirect_url)
+	v.Set("scope", strings.Join(scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", challenge(verifier))
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(meta.Authorization_endpoint, "?") {
+		sep = "&"
+	}
+	return meta.Authorization_endpoint + sep + v.Encode(), nil
+}
+
+// Exchange redeems an authorization code and returns the claims of the
+// validated ID token
+func (p *Provider) Exchange(code string, verifier string, nonce string) (Claims, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return Claims{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.Redirect_url)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.Client_id)
+
+	req, err := http.NewRequest("POST", meta.Token_endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Claims{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.secret != "" {
+		// RFC 6749 2.3.1 wants both parts form encoded before basic auth
+		req.SetBasicAuth(url.QueryEscape(p.Client_id), url.QueryEscape(p.secret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return Claims{}, err
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		Id_token          string `json:"id_token"`
+		Error             string `json:"error"`
+		Error_description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxBody)).Decode(&token); err != nil {
+		return Claims{}, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	if token.Error != "" {
+		return Claims{}, fmt.Errorf("token endpoint: %s %s", token.Error, token.Error_description)
+	}
+	if resp.StatusCode != 200 || token.Id_token == "" {
+		return Claims{}, fmt.Errorf("token endpoint returned %s without an id token", resp.Status)
+	}
+
+	return p.verify(token.Id_token, meta.Issuer, nonce, time.Now())
+}
+
+func (p *Provider) discover() (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil && time.Since(p.meta_fetched) < metadataLifetime {
+		return p.meta, nil
+	}
+
+	var meta metadata
+	if err := p.getJSON(strings.TrimRight(p.Issuer, "/")+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, err
+	}
+	// OpenID Connect Discovery 4.3, the issuer has to be exactly the one configured
+	if meta.Issuer != p.Issuer {
+		return nil, fmt.Errorf("discovery returned issuer %q, expected %q", meta.Issuer, p.Issuer)
+	}
+	if meta.Authorization_endpoint == "" || meta.Token_endpoint == "" || meta.Jwks_uri == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+
+	p.meta = &meta
+	p.meta_fetched = time.Now()
+	return p.meta, nil
+}
+
+func (p *Provider) getJSON(url string, v any) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxBody)).Decode(v)
+}
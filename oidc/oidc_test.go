@@ -0,0 +1,327 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/0sm1les/gopherbb/models"
+)
+
+var (
+	keysOnce sync.Once
+	rsaKey   *rsa.PrivateKey
+	ecKey    *ecdsa.PrivateKey
+)
+
+func testKeys(t *testing.T) {
+	t.Helper()
+	keysOnce.Do(func() {
+		var err error
+		if rsaKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatal(err)
+		}
+		if ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// mockIdP is an identity provider serving discovery, a jwks and a token
+// endpoint that checks the PKCE verifier before handing out idToken
+type mockIdP struct {
+	server *httptest.Server
+	// issuer discovery reports, the server url when empty
+	issuer    string
+	challenge string
+	idToken   string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	testKeys(t)
+	idp := &mockIdP{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer := idp.issuer
+		if issuer == "" {
+			issuer = idp.server.URL
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		encode := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": encode(rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "use": "sig", "crv": "P-256", "x": encode(ecKey.X.FillBytes(make([]byte, 32))), "y": encode(ecKey.Y.FillBytes(make([]byte, 32)))},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		client_id, _, _ := r.BasicAuth()
+		if r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("code") != "code" || client_id != "gopherbb" {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request"})
+			return
+		}
+		if challenge(r.PostFormValue("code_verifier")) != idp.challenge {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "code verifier does not match"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.idToken, "token_type": "Bearer"})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *mockIdP) provider(t *testing.T) *Provider {
+	t.Helper()
+	p, err := New(models.OIDCProvider{Name: "test", Issuer: idp.server.URL, Client_id: "gopherbb", Redirect_url: "https://forum.example.com/login/oidc/test/callback"}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func (idp *mockIdP) claims() map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":                idp.server.URL,
+		"sub":                "248289761001",
+		"aud":                "gopherbb",
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              "nonce",
+		"email":              "jane@example.com",
+		"email_verified":     "true",
+		"preferred_username": "jane",
+	}
+}
+
+// sign builds an id token, algorithms other than ES256 are signed with the rsa key
+func sign(t *testing.T, alg string, kid string, claims map[string]any) string {
+	t.Helper()
+	segment := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := segment(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	if alg == "ES256" {
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	} else {
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// login runs the flow against idp the way the callback does, with the PKCE
+// challenge the provider saw in the authorization url
+func (idp *mockIdP) login(t *testing.T, p *Provider, idToken string, verifier string) (Claims, error) {
+	t.Helper()
+	sent, err := NewVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := p.AuthURL("state", "nonce", sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.challenge = parsed.Query().Get("code_challenge")
+	idp.idToken = idToken
+	if verifier == "" {
+		verifier = sent
+	}
+	return p.Exchange("code", verifier, "nonce")
+}
+
+func TestDiscovery(t *testing.T) {
+	idp := newMockIdP(t)
+	authURL, err := idp.provider(t).AuthURL("state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Path != "/authorize" || !strings.HasPrefix(authURL, idp.server.URL) {
+		t.Errorf("auth url %s doesn't use the discovered endpoint", authURL)
+	}
+	query := parsed.Query()
+	for param, want := range map[string]string{
+		"response_type":         "code",
+		"client_id":             "gopherbb",
+		"state":                 "state",
+		"nonce":                 "nonce",
+		"code_challenge":        challenge("verifier"),
+		"code_challenge_method": "S256",
+	} {
+		if got := query.Get(param); got != want {
+			t.Errorf("%s is %q, expected %q", param, got, want)
+		}
+	}
+}
+
+func TestDiscoveryWrongIssuer(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.issuer = "https://evil.example.com"
+	if _, err := idp.provider(t).AuthURL("state", "nonce", "verifier"); err == nil {
+		t.Fatal("discovery accepted an issuer other than the configured one")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	for _, alg := range []string{"RS256", "ES256"} {
+		t.Run(alg, func(t *testing.T) {
+			idp := newMockIdP(t)
+			kid := "rsa"
+			if alg == "ES256" {
+				kid = "ec"
+			}
+			claims, err := idp.login(t, idp.provider(t), sign(t, alg, kid, idp.claims()), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Subject != "248289761001" || claims.Preferred_username != "jane" || !bool(claims.Email_verified) {
+				t.Errorf("unexpected claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestExchangeRejected(t *testing.T) {
+	idp := newMockIdP(t)
+	// each token is built by token and has to be refused with an error containing want
+	tests := map[string]struct {
+		token func() string
+		want  string
+	}{
+		"bad signature": {func() string {
+			token := sign(t, "RS256", "rsa", idp.claims())
+			parts := strings.Split(token, ".")
+			claims := idp.claims()
+			claims["sub"] = "1"
+			tampered := sign(t, "RS256", "rsa", claims)
+			return parts[0] + "." + strings.Split(tampered, ".")[1] + "." + parts[2]
+		}, "invalid id token signature"},
+		"wrong alg": {func() string {
+			return sign(t, "RS384", "rsa", idp.claims())
+		}, "unsupported id token algorithm"},
+		"alg none": {func() string {
+			token := sign(t, "none", "rsa", idp.claims())
+			return token[:strings.LastIndex(token, ".")+1]
+		}, "unsupported id token algorithm"},
+		"alg for another key type": {func() string {
+			return sign(t, "ES256", "rsa", idp.claims())
+		}, "unsupported id token algorithm"},
+		"wrong audience": {func() string {
+			claims := idp.claims()
+			claims["aud"] = []string{"someone-else"}
+			return sign(t, "RS256", "rsa", claims)
+		}, "not meant for this client"},
+		"another audience without azp": {func() string {
+			claims := idp.claims()
+			claims["aud"] = []string{"gopherbb", "someone-else"}
+			return sign(t, "RS256", "rsa", claims)
+		}, "wrong authorized party"},
+		"wrong issuer": {func() string {
+			claims := idp.claims()
+			claims["iss"] = "https://evil.example.com"
+			return sign(t, "RS256", "rsa", claims)
+		}, "wrong issuer"},
+		"expired": {func() string {
+			claims := idp.claims()
+			claims["exp"] = time.Now().Add(-2 * clockSkew).Unix()
+			return sign(t, "RS256", "rsa", claims)
+		}, "expired"},
+		"issued in the future": {func() string {
+			claims := idp.claims()
+			claims["iat"] = time.Now().Add(2 * clockSkew).Unix()
+			return sign(t, "RS256", "rsa", claims)
+		}, "issued in the future"},
+		"nonce mismatch": {func() string {
+			claims := idp.claims()
+			claims["nonce"] = "replayed"
+			return sign(t, "RS256", "rsa", claims)
+		}, "nonce does not match"},
+		"no nonce": {func() string {
+			claims := idp.claims()
+			delete(claims, "nonce")
+			return sign(t, "RS256", "rsa", claims)
+		}, "nonce does not match"},
+		"unknown key": {func() string {
+			return sign(t, "RS256", "rotated", idp.claims())
+		}, "unknown id token signing key"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			claims, err := idp.login(t, idp.provider(t), test.token(), "")
+			if err == nil {
+				t.Fatalf("accepted an id token with %s: %+v", name, claims)
+			}
+			if !strings.Contains(err.Error(), test.want) {
+				t.Errorf("refused with %q, expected %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestExchangeWithinClockSkew(t *testing.T) {
+	idp := newMockIdP(t)
+	claims := idp.claims()
+	claims["exp"] = time.Now().Add(-clockSkew / 2).Unix()
+	if _, err := idp.login(t, idp.provider(t), sign(t, "RS256", "rsa", claims), ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExchangePKCE(t *testing.T) {
+	idp := newMockIdP(t)
+	other, err := NewVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = idp.login(t, idp.provider(t), sign(t, "RS256", "rsa", idp.claims()), other)
+	if err == nil {
+		t.Fatal("exchange succeeded with a verifier that doesn't match the challenge")
+	}
+	if !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("refused with %q, expected the token endpoint to refuse the verifier", err)
+	}
+}
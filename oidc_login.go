@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/0sm1les/gopherbb/auth"
+	"github.com/0sm1les/gopherbb/mailer"
+	"github.com/0sm1les/gopherbb/models"
+	"github.com/0sm1les/gopherbb/oidc"
+	"github.com/0sm1les/gopherbb/querydb"
+
+	"github.com/gin-gonic/gin"
+)
+
+// how long a login can spend at the provider, and picking a username afterwards
+const oidcLoginTimeout = 10 * time.Minute
+
+var providers = map[string]*oidc.Provider{}
+
+// providerList keeps the config order for the login page
+var providerList []*oidc.Provider
+
+func setupProviders(confs []models.OIDCProvider) error {
+	for _, conf := range confs {
+		p, err := oidc.New(conf, os.Getenv("gopherbb_oidc_"+conf.Name+"_secret"))
+		if err != nil {
+			return err
+		}
+		providers[p.Name] = p
+		providerList = append(providerList, p)
+	}
+	return nil
+}
+
+func renderLogin(c *gin.Context, inputErrors []string) {
+	html := template.Must(newTemplate().ParseFiles("html/unauth_header.html", "html/login.html", "html/footer.html"))
+	html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "Login", "Registration": config.Registration, "Csrf": csrfToken(c)})
+	html.ExecuteTemplate(c.Writer, "html/login.html", gin.H{"Errors": inputErrors, "Registration": config.Registration, "Providers": providerList, "Csrf": csrfToken(c)})
+	html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
+}
+
+// oidcStart sends the browser to the provider. Logged in users pass ?link=1 to
+// link the provider to their account instead.
+func oidcStart(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+
+	p, ok := providers[c.Param("provider")]
+	if !ok {
+		c.Redirect(302, "/login")
+		return
+	}
+	link := uid != -1
+	if link && c.Query("link") == "" {
+		c.Redirect(302, "/")
+		return
+	}
+
+	state, err := auth.NewToken()
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	nonce, err := auth.NewToken()
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	verifier, err := oidc.NewVerifier()
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+
+	url, err := p.AuthURL(state, nonce, verifier)
+	if err != nil {
+		logger.Error().Err(err).Str("provider", p.Name).Msg("oidc discovery failed")
+		renderLogin(c, []string{p.Display_name + " is unavailable right now."})
+		return
+	}
+
+	session.Values["oidc_provider"] = p.Name
+	session.Values["oidc_state"] = state
+	session.Values["oidc_nonce"] = nonce
+	session.Values["oidc_verifier"] = verifier
+	session.Values["oidc_link"] = link
+	session.Values["oidc_time"] = time.Now().Unix()
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	c.Redirect(302, url)
+}
+
+// oidcCallback finishes the login the provider redirected back from
+func oidcCallback(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+
+	name, _ := session.Values["oidc_provider"].(string)
+	state, _ := session.Values["oidc_state"].(string)
+	nonce, _ := session.Values["oidc_nonce"].(string)
+	verifier, _ := session.Values["oidc_verifier"].(string)
+	link, _ := session.Values["oidc_link"].(bool)
+	started, _ := session.Values["oidc_time"].(int64)
+
+	// the state is single use whatever happens next
+	for _, key := range []string{"oidc_provider", "oidc_state", "oidc_nonce", "oidc_verifier", "oidc_link", "oidc_time"} {
+		delete(session.Values, key)
+	}
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+
+	p, ok := providers[c.Param("provider")]
+	if !ok || name != p.Name || state == "" ||
+		subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 ||
+		time.Since(time.Unix(started, 0)) > oidcLoginTimeout {
+		renderLogin(c, []string{"Login expired, try again."})
+		return
+	}
+	if c.Query("error") != "" {
+		renderLogin(c, []string{p.Display_name + " did not sign you in."})
+		return
+	}
+
+	claims, err := p.Exchange(c.Query("code"), verifier, nonce)
+	if err != nil {
+		logger.Error().Err(err).Str("provider", p.Name).Msg("oidc login failed")
+		renderLogin(c, []string{"Could not sign in with " + p.Display_name + "."})
+		return
+	}
+
+	linked_uid, err := querydb.IdentityUser(p.Name, claims.Subject)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+
+	if link {
+		if uid == -1 {
+			renderLogin(c, []string{"Login expired, try again."})
+			return
+		}
+		if linked_uid == -1 {
+			if err := querydb.LinkIdentity(uid, p.Name, claims.Subject); err != nil {
+				logger.Error().Err(err).Msg("")
+				renderLinkError(c, uid, "Could not link "+p.Display_name+", try again.")
+				return
+			}
+		} else if linked_uid != uid {
+			logger.Warn().Str("provider", p.Name).Msg("identity is already linked to another account")
+			renderLinkError(c, uid, "This "+p.Display_name+" login is already linked to another account.")
+			return
+		}
+		c.Redirect(302, "/user/settings")
+		return
+	}
+
+	if linked_uid != -1 {
+		userinfo, err := querydb.Userinfo(linked_uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		finishOIDCLogin(userinfo, c)
+		return
+	}
+
+	if !p.Auto_provision || provisionStatus() == "" {
+		renderLogin(c, []string{"No account is linked to this " + p.Display_name + " login. Log in and link it from your settings."})
+		return
+	}
+
+	email := ""
+	if claims.Email_verified {
+		if verified, err := mailer.ValidateAddress(claims.Email); err == nil {
+			email = verified
+		}
+	}
+
+	// use the provider's username when it is valid here and free
+	suggestion := claims.Preferred_username
+	if suggestion == "" {
+		suggestion, _, _ = strings.Cut(claims.Email, "@")
+	}
+	if username, err := auth.ValidateUser(suggestion); err == nil && querydb.UserExists(username) == -1 {
+		provisionUser(c, p, claims.Subject, username, email)
+		return
+	}
+
+	session.Values["oidc_pending_provider"] = p.Name
+	session.Values["oidc_pending_subject"] = claims.Subject
+	session.Values["oidc_pending_email"] = email
+	session.Values["oidc_pending_time"] = time.Now().Unix()
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	renderOIDCUsername(c, suggestion, nil)
+}
+
+// renderLinkError tells a logged in user why linking a provider from their settings failed
+func renderLinkError(c *gin.Context, uid int32, message string) {
+	userinfo, err := querydb.Userinfo(uid)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/message.html", "html/footer.html"))
+	html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "link login", "Userinfo": userinfo, "Csrf": csrfToken(c)})
+	html.ExecuteTemplate(c.Writer, "html/message.html", gin.H{"Message": message})
+	html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
+}
+
+func renderOIDCUsername(c *gin.Context, suggestion string, inputErrors []string) {
+	html := template.Must(newTemplate().ParseFiles("html/unauth_header.html", "html/oidc_username.html", "html/footer.html"))
+	html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "Pick a username", "Registration": config.Registration, "Csrf": csrfToken(c)})
+	html.ExecuteTemplate(c.Writer, "html/oidc_username.html", gin.H{"Username": suggestion, "Errors": inputErrors, "Csrf": csrfToken(c)})
+	html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
+}
+
+// oidcUsername creates the account for a provider login whose username was taken or invalid
+func oidcUsername(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+
+	name, _ := session.Values["oidc_pending_provider"].(string)
+	subject, _ := session.Values["oidc_pending_subject"].(string)
+	email, _ := session.Values["oidc_pending_email"].(string)
+	started, _ := session.Values["oidc_pending_time"].(int64)
+	p, ok := providers[name]
+	if !ok || subject == "" || time.Since(time.Unix(started, 0)) > oidcLoginTimeout {
+		renderLogin(c, []string{"Login expired, try again."})
+		return
+	}
+
+	username, err := auth.ValidateUser(c.PostForm("username"))
+	if err != nil {
+		renderOIDCUsername(c, c.PostForm("username"), []string{err.Error()})
+		return
+	}
+	if querydb.UserExists(username) != -1 {
+		renderOIDCUsername(c, string(username), []string{"user already exists"})
+		return
+	}
+
+	for _, key := range []string{"oidc_pending_provider", "oidc_pending_subject", "oidc_pending_email", "oidc_pending_time"} {
+		delete(session.Values, key)
+	}
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	provisionUser(c, p, subject, username, email)
+}
+
+// provisionStatus is the status a provisioned account starts with under the
+// registration mode, "" when the mode doesn't let provider logins create one
+func provisionStatus() string {
+	switch config.Registration {
+	case "open":
+		return "active"
+	case "approval":
+		return "pending"
+	}
+	// invites can't be checked for a provider login, closed takes nobody
+	return ""
+}
+
+func provisionUser(c *gin.Context, p *oidc.Provider, subject string, username models.Username, email string) {
+	status := provisionStatus()
+	if status == "" {
+		renderLogin(c, []string{"No account is linked to this " + p.Display_name + " login. Log in and link it from your settings."})
+		return
+	}
+	user_id, err := querydb.CreateIdentityUser(username, status, p.Name, subject, email)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		renderLogin(c, []string{"Could not create your account."})
+		return
+	}
+	logger.Info().Str("provider", p.Name).Str("username", string(username)).Msg("provisioned user from oidc login")
+
+	userinfo, err := querydb.Userinfo(user_id)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	finishOIDCLogin(userinfo, c)
+}
+
+// finishOIDCLogin applies the same account checks as a password login
+func finishOIDCLogin(userinfo models.User, c *gin.Context) {
+	if userinfo.Status == "pending" {
+		renderLogin(c, []string{"Your account is waiting for a moderator to approve it."})
+		return
+	} else if userinfo.Status == "rejected" {
+		renderLogin(c, []string{"Your registration was not approved."})
+		return
+	}
+	if lockout, err := lockoutMessage(userinfo.Id); err != nil || lockout != "" {
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		renderLogin(c, []string{lockout})
+		return
+	}
+	if userinfo.Totp_enabled {
+		startTwoFactor(userinfo.Id, c)
+		return
+	}
+	if err := completeLogin(userinfo, c); err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	// redirect so the code and state don't stay in the address bar
+	c.Redirect(302, "/")
+}
+
+// unlinkIdentity removes a provider from the settings page
+func unlinkIdentity(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		userinfo, err := querydb.Userinfo(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		identities, err := querydb.UserIdentities(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if userinfo.Password == "" && len(identities) <= 1 {
+			html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+			html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "set a password before removing your only login"})
+			return
+		}
+		if err := querydb.UnlinkIdentity(uid, c.Param("provider")); err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "ok", "Message": "unlinked"})
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"html/template"
+	"time"
+
+	"github.com/0sm1les/gopherbb/auth"
+	"github.com/0sm1les/gopherbb/models"
+	"github.com/0sm1les/gopherbb/querydb"
+
+	"github.com/gin-gonic/gin"
+)
+
+const passwordResetLifetime = 24 * time.Hour
+
+// changePassword checks the current password before setting a new one and
+// logs out every other session
+func changePassword(uid int32, c *gin.Context) {
+	userinfo, err := querydb.Userinfo(uid)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+
+	feedback := func(result string, message string) {
+		html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": result, "Message": message})
+	}
+
+	// share the login limiter so a stolen session can't be used to guess the password
+	locked, err := loginLocked(c, userinfo.Username)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+	}
+	if locked != "" {
+		feedback("error", locked)
+		return
+	}
+
+	// accounts made through an identity provider can set a first password without one
+	if userinfo.Password != "" {
+		current, err := auth.ValidatePassword(c.PostForm("current_password"))
+		ok := false
+		if err == nil {
+			ok, err = auth.ComparePassword(current, userinfo.Password)
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+			}
+		}
+		if !ok {
+			feedback("error", loginFailed(c, userinfo.Username, "current password is incorrect"))
+			return
+		}
+	}
+
+	new_password := c.PostForm("new_password")
+	verified_pass, err := auth.ValidatePassword(new_password)
+	if err != nil {
+		feedback("error", err.Error())
+		return
+	}
+	if new_password != c.PostForm("confirm_password") {
+		feedback("error", "passwords do not match")
+		return
+	}
+
+	hash, err := auth.Hashpassword(verified_pass)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		feedback("error", "error changing password")
+		return
+	}
+	if err := querydb.SetPassword(uid, hash); err != nil {
+		logger.Error().Err(err).Msg("")
+		feedback("error", "error changing password")
+		return
+	}
+
+	session, _ := store.Get(c.Request, "session")
+	sid, _ := session.Values["sid"].(string)
+	if err := querydb.RevokeOtherSessions(uid, auth.HashToken(sid)); err != nil {
+		logger.Error().Err(err).Msg("")
+	}
+	loginSucceeded(userinfo.Username)
+	feedback("ok", "password changed, other sessions were logged out")
+}
+
+// adminPasswordReset lets an admin hand a user a single use reset link
+func adminPasswordReset(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		user, err := auth.ValidateUser(c.Param("user"))
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		other_uid := querydb.UserExists(user)
+		if other_uid == -1 {
+			return
+		}
+
+		token, err := auth.NewToken()
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if err := querydb.NewPasswordReset(other_uid, uid, auth.HashToken(token), int64(passwordResetLifetime.Seconds()),
+			&models.ModAction{Actor: uid, Action: "user.password_reset", Target_type: "user", Target_id: other_uid}); err != nil {
+			logger.Error().Err(err).Msg("")
+			html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+			html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "error creating reset link"})
+			return
+		}
+
+		html := template.Must(newTemplate().ParseFiles("html/htmx/reset_link.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/reset_link.html", gin.H{"Token": token, "Username": user, "Hours": int(passwordResetLifetime.Hours())})
+	}
+}
+
+// resetPassword is the page a reset link opens
+func resetPassword(c *gin.Context) {
+	initsession(c)
+	// keep the token out of the referer of anything linked from the page
+	c.Header("Referrer-Policy", "no-referrer")
+
+	token := c.Param("token")
+	renderReset := func(inputErrors []string) {
+		html := template.Must(newTemplate().ParseFiles("html/unauth_header.html", "html/reset.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "Reset password", "Registration": config.Registration, "Csrf": csrfToken(c)})
+		html.ExecuteTemplate(c.Writer, "html/reset.html", gin.H{"Token": token, "Errors": inputErrors, "Csrf": csrfToken(c)})
+		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
+	}
+
+	if c.Request.Method == "GET" {
+		if _, err := querydb.PasswordResetUser(auth.HashToken(token)); err != nil {
+			if err != querydb.ErrInvalidReset {
+				logger.Error().Err(err).Msg("")
+			}
+			renderReset([]string{querydb.ErrInvalidReset.Error()})
+			return
+		}
+		renderReset(nil)
+	} else if c.Request.Method == "POST" {
+		password := c.PostForm("password")
+		verified_pass, err := auth.ValidatePassword(password)
+		if err != nil {
+			renderReset([]string{err.Error()})
+			return
+		}
+		if password != c.PostForm("confirm_password") {
+			renderReset([]string{"passwords do not match"})
+			return
+		}
+
+		hash, err := auth.Hashpassword(verified_pass)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		user_id, err := querydb.ResetPassword(auth.HashToken(token), hash)
+		if err == querydb.ErrInvalidReset {
+			renderReset([]string{err.Error()})
+			return
+		} else if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+
+		if user, err := querydb.GetUser(user_id); err == nil {
+			loginSucceeded(user.Username)
+		}
+
+		html := template.Must(newTemplate().ParseFiles("html/unauth_header.html", "html/login.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "Login", "Registration": config.Registration, "Csrf": csrfToken(c)})
+		html.ExecuteTemplate(c.Writer, "html/login.html", gin.H{"Registration": config.Registration, "Notice": "Password changed, you can log in now.", "Csrf": csrfToken(c)})
+		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/0sm1les/gopherbb/models"
+	"github.com/0sm1les/gopherbb/querydb"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	capPostCreate        = "post.create"
+	capPostEditOwn       = "post.edit.own"
+	capPostEditAny       = "post.edit.any"
+	capPostDeleteOwn     = "post.delete.own"
+	capPostDeleteAny     = "post.delete.any"
+	capPostLike          = "post.like"
+	capPostApprove       = "post.approve"
+	capPostLock          = "post.lock"
+	capPostPin           = "post.pin"
+	capPostMove          = "post.move"
+	capCommentCreate     = "comment.create"
+	capCommentDeleteOwn  = "comment.delete.own"
+	capCommentDeleteAny  = "comment.delete.any"
+	capCommentEditOwn    = "comment.edit.own"
+	capCommentEditAny    = "comment.edit.any"
+	capCommentHistory    = "comment.history"
+	capInviteCreate      = "invite.create"
+	capInviteUnlimited   = "invite.unlimited"
+	capUserApprove       = "user.approve"
+	capUserBan           = "user.ban"
+	capUserSessions      = "user.sessions"
+	capUserPasswordReset = "user.password_reset"
+	capModLogView        = "modlog.view"
+	capReportCreate      = "report.create"
+	capReportReview      = "report.review"
+	capDashboardView     = "dashboard.view"
+	capUserRole          = "user.role"
+	capContentRestore    = "content.restore"
+)
+
+var capabilities = []string{
+	capPostCreate, capPostEditOwn, capPostEditAny, capPostDeleteOwn, capPostDeleteAny, capPostLike, capPostApprove,
+	capPostLock, capPostPin, capPostMove,
+	capCommentCreate, capCommentDeleteOwn, capCommentDeleteAny, capCommentEditOwn, capCommentEditAny, capCommentHistory,
+	capInviteCreate, capInviteUnlimited,
+	capUserApprove, capUserBan, capUserSessions, capUserPasswordReset, capUserRole,
+	capModLogView,
+	capReportCreate, capReportReview,
+	capDashboardView, capContentRestore,
+}
+
+var member = []string{capPostCreate, capPostEditOwn, capPostDeleteOwn, capPostLike, capCommentCreate, capCommentDeleteOwn, capCommentEditOwn, capReportCreate}
+
+// defaultRoles is used for every role config.Roles leaves out
+var defaultRoles = map[string][]string{
+	"unranked": member,
+	"ranked":   append(append([]string{}, member...), capInviteCreate),
+	"mod":      append(append([]string{}, member...), capInviteCreate, capPostEditAny, capPostDeleteAny, capPostApprove, capPostLock, capPostPin, capPostMove, capCommentDeleteAny, capCommentEditAny, capCommentHistory, capUserApprove, capUserBan, capReportReview, capDashboardView, capContentRestore),
+	"admin":    capabilities,
+}
+
+// roleOrder lists the roles from least to most trusted
+var roleOrder = []string{"unranked", "ranked", "mod", "admin"}
+
+// roleRank is the position of role in roleOrder, -1 for unknown roles
+func roleRank(role string) int {
+	for i, r := range roleOrder {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// roles maps a role to the set of capabilities it has
+var roles = map[string]map[string]bool{}
+
+func setupRoles(conf map[string][]string) error {
+	for role := range conf {
+		if _, ok := defaultRoles[role]; !ok {
+			return fmt.Errorf("unknown role %q", role)
+		}
+	}
+	for role, defaults := range defaultRoles {
+		granted, ok := conf[role]
+		if !ok {
+			granted = defaults
+		}
+		roles[role] = map[string]bool{}
+		for _, capability := range granted {
+			if !validCapability(capability) {
+				return fmt.Errorf("unknown capability %q for role %s", capability, role)
+			}
+			roles[role][capability] = true
+		}
+	}
+	return nil
+}
+
+func validCapability(capability string) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+func can(role string, capability string) bool {
+	return roles[role][capability]
+}
+
+// canModify checks a user against owner_uid, using own for their own content and others otherwise
+func canModify(userinfo models.User, owner_uid int32, own string, others string) bool {
+	if owner_uid == userinfo.Id {
+		return can(userinfo.Role, own)
+	}
+	return can(userinfo.Role, others)
+}
+
+// requireCapability stops logged in users whose role lacks capability.
+// Logged out requests are left to the handler.
+func requireCapability(capability string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, _ := store.Get(c.Request, "session")
+		uid, _ := session.Values["id"].(int32)
+		if uid <= 0 {
+			c.Next()
+			return
+		}
+		userinfo, err := querydb.Userinfo(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			c.AbortWithStatus(500)
+			return
+		}
+		if !can(userinfo.Role, capability) {
+			logger.Warn().Str("capability", capability).Str("username", string(userinfo.Username)).Msg("user tried to access unauthorized resource")
+			c.AbortWithStatus(403)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode/utf8"
+
+	"github.com/0sm1les/gopherbb/models"
+
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+const defaultRel = "nofollow ugc noopener"
+
+// contentPolicy is config.Policy compiled, it is swapped as a whole on reload
+type contentPolicy struct {
+	blocked  []*regexp.Regexp
+	replaced []termReplacement
+	rules    []policyRule
+	allowed  []string
+	denied   []string
+	rel      string
+	// config.Unranked.No_links, kept here so it reloads with the rest of the policy
+	unrankedLinks bool
+}
+
+type termReplacement struct {
+	pattern *regexp.Regexp
+	with    string
+}
+
+type policyRule struct {
+	pattern     *regexp.Regexp
+	block       bool
+	replacement string
+	message     string
+}
+
+var (
+	policyMu sync.RWMutex
+	policy   = &contentPolicy{rel: defaultRel}
+)
+
+func currentPolicy() *contentPolicy {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	return policy
+}
+
+// termPattern matches term as a whole word ignoring case. A word boundary is
+// only required on a side that ends in a word character, so terms like "c++"
+// or "$$$" still match.
+func termPattern(term string) (*regexp.Regexp, error) {
+	if term == "" {
+		return nil, errors.New("policy terms can't be empty")
+	}
+	pattern := regexp.QuoteMeta(term)
+	if first, _ := utf8.DecodeRuneInString(term); wordChar(first) {
+		pattern = `\b` + pattern
+	}
+	if last, _ := utf8.DecodeLastRuneInString(term); wordChar(last) {
+		pattern += `\b`
+	}
+	return regexp.Compile(`(?i)` + pattern)
+}
+
+// wordChar is what \b counts as part of a word, go's regexp only knows ascii ones
+func wordChar(r rune) bool {
+	return r == '_' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+func compilePolicy(conf models.PolicyConfig, unranked models.UnrankedConfig) (*contentPolicy, error) {
+	compiled := &contentPolicy{rel: conf.Links.Rel, unrankedLinks: unranked.No_links}
+	if compiled.rel == "" {
+		compiled.rel = defaultRel
+	}
+	for _, term := range conf.Blocked {
+		pattern, err := termPattern(term)
+		if err != nil {
+			return nil, err
+		}
+		compiled.blocked = append(compiled.blocked, pattern)
+	}
+	// longest terms first so a phrase is replaced before the words in it
+	terms := make([]string, 0, len(conf.Replaced))
+	for term := range conf.Replaced {
+		terms = append(terms, term)
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if len(terms[i]) != len(terms[j]) {
+			return len(terms[i]) > len(terms[j])
+		}
+		return terms[i] < terms[j]
+	})
+	for _, term := range terms {
+		pattern, err := termPattern(term)
+		if err != nil {
+			return nil, err
+		}
+		compiled.replaced = append(compiled.replaced, termReplacement{pattern: pattern, with: conf.Replaced[term]})
+	}
+	for _, rule := range conf.Rules {
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		if rule.Action != "block" && rule.Action != "replace" {
+			return nil, fmt.Errorf("unknown action %q for rule %q", rule.Action, rule.Pattern)
+		}
+		compiled.rules = append(compiled.rules, policyRule{pattern: pattern, block: rule.Action == "block", replacement: rule.Replacement, message: rule.Message})
+	}
+	for _, domain := range conf.Links.Allowed_domains {
+		compiled.allowed = append(compiled.allowed, strings.ToLower(domain))
+	}
+	for _, domain := range conf.Links.Denied_domains {
+		compiled.denied = append(compiled.denied, strings.ToLower(domain))
+	}
+	return compiled, nil
+}
+
+func setupPolicy(conf models.PolicyConfig, unranked models.UnrankedConfig) error {
+	compiled, err := compilePolicy(conf, unranked)
+	if err != nil {
+		return err
+	}
+	policyMu.Lock()
+	policy = compiled
+	policyMu.Unlock()
+	return nil
+}
+
+// reloadPolicy rereads the policy from conf_file on SIGHUP, a broken config keeps the old policy
+func reloadPolicy(conf_file string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		data, err := os.ReadFile(conf_file)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			continue
+		}
+		var reloaded models.Config
+		if err := json.Unmarshal(data, &reloaded); err != nil {
+			logger.Error().Err(err).Msg("")
+			continue
+		}
+		if err := setupPolicy(reloaded.Policy, reloaded.Unranked); err != nil {
+			logger.Error().Err(err).Msg("invalid policy, keeping the current one")
+			continue
+		}
+		logger.Info().Msg("reloaded content policy")
+	}
+}
+
+// applyPolicy returns markdown with censored terms replaced, or why it is refused
+func applyPolicy(markdown string) (string, string) {
+	p := currentPolicy()
+	for _, pattern := range p.blocked {
+		if pattern.MatchString(markdown) {
+			return "", "this contains a word that isn't allowed here"
+		}
+	}
+	for _, term := range p.replaced {
+		markdown = term.pattern.ReplaceAllStringFunc(markdown, func(match string) string {
+			if term.with == "" {
+				return strings.Repeat("*", utf8.RuneCountInString(match))
+			}
+			return term.with
+		})
+	}
+	for _, rule := range p.rules {
+		if !rule.block {
+			markdown = rule.pattern.ReplaceAllString(markdown, rule.replacement)
+		} else if rule.pattern.MatchString(markdown) {
+			if rule.message != "" {
+				return "", rule.message
+			}
+			return "", "this contains something that isn't allowed here"
+		}
+	}
+	for _, host := range linkHosts(markdown) {
+		if !p.linkAllowed(host) {
+			return "", "links to " + host + " aren't allowed"
+		}
+	}
+	return markdown, ""
+}
+
+func (p *contentPolicy) linkAllowed(host string) bool {
+	for _, domain := range p.denied {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return false
+		}
+	}
+	if len(p.allowed) == 0 {
+		return true
+	}
+	for _, domain := range p.allowed {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// linkHosts returns the hosts that links and images in markdown point to, relative links have none
+func linkHosts(markdown string) []string {
+	source := []byte(markdown)
+	var hosts []string
+	ast.Walk(md.Parser().Parse(text.NewReader(source)), func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		var destination []byte
+		switch node := n.(type) {
+		case *ast.Link:
+			destination = node.Destination
+		case *ast.Image:
+			destination = node.Destination
+		case *ast.AutoLink:
+			if node.AutoLinkType == ast.AutoLinkEmail {
+				return ast.WalkContinue, nil
+			}
+			destination = node.URL(source)
+		default:
+			return ast.WalkContinue, nil
+		}
+		if u, err := url.Parse(string(destination)); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, strings.ToLower(u.Hostname()))
+		}
+		return ast.WalkContinue, nil
+	})
+	return hosts
+}
+
+// relTransformer adds the policy's rel attribute to every link md renders
+type relTransformer struct{}
+
+func (relTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	rel := []byte(currentPolicy().rel)
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering && (n.Kind() == ast.KindLink || n.Kind() == ast.KindAutoLink) {
+			n.SetAttributeString("rel", rel)
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+// filterPost applies the policy to a post's title and markdown, returning why it is refused
+func filterPost(post *models.Post) string {
+	title, refused := applyPolicy(post.Title)
+	if refused != "" {
+		return refused
+	}
+	markdown, refused := applyPolicy(post.Md)
+	if refused != "" {
+		return refused
+	}
+	post.Title, post.Md = title, markdown
+	return ""
+}
@@ -0,0 +1,22 @@
+package pow
+
+import (
+	"time"
+
+	"github.com/0sm1les/gopherbb/querydb"
+)
+
+// Postgres keeps used challenges in the used_challenges table
+type Postgres struct{}
+
+func NewPostgres() *Postgres {
+	return &Postgres{}
+}
+
+func (p *Postgres) Use(challenge string, expiry time.Time) (bool, error) {
+	return querydb.UseChallenge(challenge, expiry.UTC())
+}
+
+func (p *Postgres) Purge(now time.Time) error {
+	return querydb.PurgeChallenges(now.UTC())
+}
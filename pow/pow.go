@@ -0,0 +1,109 @@
+// Package pow issues and verifies hashcash style proof of work challenges.
+//
+// A challenge is "<expiry>.<difficulty>.<random>.<signature>" and is solved by a
+// nonce for which sha256(challenge + ":" + nonce) starts with difficulty zero
+// bits. Challenges are signed so nothing is stored until one is solved, solved
+// challenges are then remembered by a Used store until they expire so each is
+// only used once.
+package pow
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalid  = errors.New("invalid challenge")
+	ErrExpired  = errors.New("challenge expired")
+	ErrUsed     = errors.New("challenge already used")
+	ErrUnsolved = errors.New("challenge not solved")
+)
+
+// Failed reports whether err from Verify is the answer's fault rather than the Used store's
+func Failed(err error) bool {
+	return err == ErrInvalid || err == ErrExpired || err == ErrUsed || err == ErrUnsolved
+}
+
+type Challenges struct {
+	key  []byte
+	used Used
+}
+
+func New(key []byte, used Used) *Challenges {
+	return &Challenges{key: key, used: used}
+}
+
+// sign binds a challenge to what it was issued for so it can't be solved once and used elsewhere
+func (c *Challenges) sign(purpose string, payload string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(purpose + ":" + payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns a challenge for purpose that needs difficulty leading zero bits
+func (c *Challenges) Issue(purpose string, difficulty int, lifetime time.Duration) string {
+	random := make([]byte, 16)
+	rand.Read(random)
+	payload := strconv.FormatInt(time.Now().Add(lifetime).Unix(), 10) + "." + strconv.Itoa(difficulty) + "." + hex.EncodeToString(random)
+	return payload + "." + c.sign(purpose, payload)
+}
+
+// Verify checks that nonce solves challenge and that the challenge was issued
+// for purpose and hasn't been used before
+func (c *Challenges) Verify(purpose string, challenge string, nonce string) error {
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 4 || len(nonce) == 0 || len(nonce) > 20 {
+		return ErrInvalid
+	}
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(parts[3]), []byte(c.sign(purpose, payload))) {
+		return ErrInvalid
+	}
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return ErrInvalid
+	}
+	difficulty, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return ErrInvalid
+	}
+	if time.Now().Unix() > expiry {
+		return ErrExpired
+	}
+	sum := sha256.Sum256([]byte(challenge + ":" + nonce))
+	if LeadingZeroBits(sum[:]) < difficulty {
+		return ErrUnsolved
+	}
+
+	fresh, err := c.used.Use(challenge, time.Unix(expiry, 0))
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrUsed
+	}
+	return nil
+}
+
+// Purge forgets used challenges that have expired and can't be replayed anymore
+func (c *Challenges) Purge() error {
+	return c.used.Purge(time.Now())
+}
+
+func LeadingZeroBits(sum []byte) int {
+	zeros := 0
+	for _, b := range sum {
+		if b != 0 {
+			return zeros + bits.LeadingZeros8(b)
+		}
+		zeros += 8
+	}
+	return zeros
+}
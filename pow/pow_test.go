@@ -0,0 +1,146 @@
+package pow
+
+import (
+	"crypto/sha256"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// solve finds a nonce for challenge, want picks whether it has to meet difficulty or miss it
+func solve(t *testing.T, challenge string, difficulty int, want bool) string {
+	t.Helper()
+	for i := 0; i < 1<<20; i++ {
+		nonce := strconv.Itoa(i)
+		sum := sha256.Sum256([]byte(challenge + ":" + nonce))
+		if (LeadingZeroBits(sum[:]) >= difficulty) == want {
+			return nonce
+		}
+	}
+	t.Fatal("no nonce found")
+	return ""
+}
+
+func newChallenges() *Challenges {
+	return New([]byte("test key"), NewMemory())
+}
+
+func TestVerify(t *testing.T) {
+	c := newChallenges()
+	challenge := c.Issue("post", 8, time.Minute)
+	if err := c.Verify("post", challenge, solve(t, challenge, 8, true)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyUnsolved(t *testing.T) {
+	c := newChallenges()
+	challenge := c.Issue("post", 8, time.Minute)
+	if err := c.Verify("post", challenge, solve(t, challenge, 8, false)); err != ErrUnsolved {
+		t.Fatalf("got %v, expected %v", err, ErrUnsolved)
+	}
+}
+
+func TestVerifyLoweredDifficulty(t *testing.T) {
+	c := newChallenges()
+	parts := strings.Split(c.Issue("post", 20, time.Minute), ".")
+	parts[1] = "0"
+	challenge := strings.Join(parts, ".")
+	if err := c.Verify("post", challenge, "1"); err != ErrInvalid {
+		t.Fatalf("got %v, expected %v", err, ErrInvalid)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	c := newChallenges()
+	challenge := c.Issue("post", 8, time.Minute)
+	tests := map[string]string{
+		"signature": challenge[:len(challenge)-1] + "0",
+		"payload":   strings.Replace(challenge, ".", ".0", 2),
+		"other key": New([]byte("other key"), NewMemory()).Issue("post", 8, time.Minute),
+		"malformed": "1.2.3",
+	}
+	if strings.HasSuffix(challenge, "0") {
+		tests["signature"] = challenge[:len(challenge)-1] + "1"
+	}
+	for name, tampered := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := c.Verify("post", tampered, solve(t, tampered, 8, true)); err != ErrInvalid {
+				t.Fatalf("got %v, expected %v", err, ErrInvalid)
+			}
+		})
+	}
+}
+
+func TestVerifyWrongPurpose(t *testing.T) {
+	c := newChallenges()
+	challenge := c.Issue("register", 8, time.Minute)
+	if err := c.Verify("post", challenge, solve(t, challenge, 8, true)); err != ErrInvalid {
+		t.Fatalf("got %v, expected %v", err, ErrInvalid)
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	c := newChallenges()
+	challenge := c.Issue("post", 8, -2*time.Second)
+	if err := c.Verify("post", challenge, solve(t, challenge, 8, true)); err != ErrExpired {
+		t.Fatalf("got %v, expected %v", err, ErrExpired)
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	c := newChallenges()
+	challenge := c.Issue("post", 8, time.Minute)
+	nonce := solve(t, challenge, 8, true)
+	if err := c.Verify("post", challenge, nonce); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Verify("post", challenge, nonce); err != ErrUsed {
+		t.Fatalf("got %v, expected %v", err, ErrUsed)
+	}
+	// another solution of the same challenge is a replay too
+	from, _ := strconv.Atoi(nonce)
+	for i := from + 1; ; i++ {
+		sum := sha256.Sum256([]byte(challenge + ":" + strconv.Itoa(i)))
+		if LeadingZeroBits(sum[:]) >= 8 {
+			if err := c.Verify("post", challenge, strconv.Itoa(i)); err != ErrUsed {
+				t.Fatalf("got %v, expected %v", err, ErrUsed)
+			}
+			return
+		}
+	}
+}
+
+func TestMemoryPurge(t *testing.T) {
+	used := NewMemory()
+	now := time.Now()
+	used.Use("expired", now.Add(-time.Second))
+	used.Use("current", now.Add(time.Minute))
+	if err := used.Purge(now); err != nil {
+		t.Fatal(err)
+	}
+	if fresh, _ := used.Use("expired", now.Add(time.Minute)); !fresh {
+		t.Error("an expired challenge was kept")
+	}
+	if fresh, _ := used.Use("current", now.Add(time.Minute)); fresh {
+		t.Error("a challenge that hasn't expired was forgotten")
+	}
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	tests := []struct {
+		sum  []byte
+		want int
+	}{
+		{[]byte{0x80, 0}, 0},
+		{[]byte{0x01, 0}, 7},
+		{[]byte{0, 0x10}, 11},
+		{[]byte{0, 0}, 16},
+	}
+	for _, test := range tests {
+		if got := LeadingZeroBits(test.sum); got != test.want {
+			t.Errorf("LeadingZeroBits(%x) = %d, expected %d", test.sum, got, test.want)
+		}
+	}
+}
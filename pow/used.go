@@ -0,0 +1,45 @@
+package pow
+
+import (
+	"sync"
+	"time"
+)
+
+// Used remembers solved challenges until they expire. Memory is fine for a
+// single instance, Postgres shares them between instances and restarts.
+type Used interface {
+	// Use records challenge and reports false when it was already recorded
+	Use(challenge string, expiry time.Time) (bool, error)
+	// Purge drops challenges that expired before now
+	Purge(now time.Time) error
+}
+
+type Memory struct {
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{used: make(map[string]time.Time)}
+}
+
+func (m *Memory) Use(challenge string, expiry time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.used[challenge]; ok {
+		return false, nil
+	}
+	m.used[challenge] = expiry
+	return true, nil
+}
+
+func (m *Memory) Purge(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for challenge, expiry := range m.used {
+		if expiry.Before(now) {
+			delete(m.used, challenge)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"strconv"
+	"time"
+
+	"github.com/0sm1les/gopherbb/models"
+	"github.com/0sm1les/gopherbb/querydb"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+var (
+	promotionInterval time.Duration
+	promotionMinAge   time.Duration
+	unrankedInterval  time.Duration
+)
+
+func setupPromotion(promotion models.PromotionConfig, unranked models.UnrankedConfig) error {
+	var err error
+	if promotion.Interval != "" {
+		if promotionInterval, err = time.ParseDuration(promotion.Interval); err != nil {
+			return err
+		}
+	}
+	if promotion.Min_age != "" {
+		if promotionMinAge, err = time.ParseDuration(promotion.Min_age); err != nil {
+			return err
+		}
+	}
+	if unranked.Post_interval != "" {
+		if unrankedInterval, err = time.ParseDuration(unranked.Post_interval); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// promoteUsers moves unranked users that meet config.Promotion to ranked
+func promoteUsers() {
+	for range time.Tick(promotionInterval) {
+		uids, err := querydb.PromotionCandidates(int64(promotionMinAge.Seconds()),
+			config.Promotion.Min_posts,
+			config.Promotion.Min_comments,
+			config.Promotion.Min_likes)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			continue
+		}
+		for _, uid := range uids {
+			promoted, err := querydb.Promote(uid)
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				continue
+			}
+			if !promoted {
+				continue
+			}
+			logger.Info().Int32("uid", uid).Msg("promoted user to ranked")
+			if err := querydb.NewNotification(uid, uid, "Your account was promoted to ranked, thanks for taking part!"); err != nil {
+				logger.Error().Err(err).Msg("")
+			}
+		}
+	}
+}
+
+// unrankedRestriction returns why userinfo can't publish markdown yet, or "" when they can
+func unrankedRestriction(userinfo models.User, markdown string) (string, error) {
+	if userinfo.Role != "unranked" {
+		return "", nil
+	}
+	if linksRefused(userinfo, markdown) {
+		return "new accounts can't post links", nil
+	}
+	if unrankedInterval > 0 {
+		posted, err := querydb.PostedWithin(userinfo.Id, int64(unrankedInterval.Seconds()))
+		if err != nil {
+			return "", err
+		}
+		if posted {
+			return "new accounts can only post once every " + unrankedInterval.String(), nil
+		}
+	}
+	return "", nil
+}
+
+func linksRefused(userinfo models.User, markdown string) bool {
+	return userinfo.Role == "unranked" && currentPolicy().unrankedLinks && hasLinks(markdown)
+}
+
+func hasLinks(markdown string) bool {
+	source := []byte(markdown)
+	found := false
+	ast.Walk(md.Parser().Parse(text.NewReader(source)), func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering && (n.Kind() == ast.KindLink || n.Kind() == ast.KindAutoLink) {
+			found = true
+			return ast.WalkStop, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	return found
+}
+
+// publishStatus is "queued" while userinfo's first posts need a moderator, "posted" otherwise
+func publishStatus(userinfo models.User) (string, error) {
+	if userinfo.Role != "unranked" || config.Unranked.Queued_posts <= 0 {
+		return "posted", nil
+	}
+	count, err := querydb.PostedCount(userinfo.Id)
+	if err != nil {
+		return "", err
+	}
+	if count < config.Unranked.Queued_posts {
+		return "queued", nil
+	}
+	return "posted", nil
+}
+
+// postQueue is where mods approve the first posts of unranked users
+func postQueue(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		userinfo, err := querydb.Userinfo(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if c.Request.Method == "GET" {
+			posts, err := querydb.QueuedPosts()
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+			for i := 0; i < len(posts); i++ {
+				posts[i].User, err = querydb.GetUser(posts[i].Uid)
+				if err != nil {
+					logger.Error().Err(err).Msg("")
+					return
+				}
+				posts[i].Time_formatted = formattedTime(posts[i].Time_posted)
+			}
+
+			html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/post_queue.html", "html/footer.html"))
+			html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "post queue", "Userinfo": userinfo, "Csrf": csrfToken(c)})
+			html.ExecuteTemplate(c.Writer, "html/post_queue.html", gin.H{"Posts": posts})
+			html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
+		} else if c.Request.Method == "POST" {
+			pid, err := strconv.ParseInt(c.Param("pid"), 10, 32)
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+
+			status := ""
+			if c.Param("decision") == "approve" {
+				status = "posted"
+			} else if c.Param("decision") == "reject" {
+				status = "deleted"
+			} else {
+				return
+			}
+
+			changed, err := querydb.SetQueuedPostStatus(int32(pid), status,
+				&models.ModAction{Actor: uid, Action: "post." + c.Param("decision"), Target_type: "post", Target_id: int32(pid)})
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+			if changed && status == "posted" {
+				poster, section, title, err := querydb.GetPostOP(int32(pid))
+				if err != nil {
+					logger.Error().Err(err).Msg("")
+					return
+				}
+				title = template.HTMLEscapeString(title)
+				err = querydb.NewPostNotification(poster, uid, int32(pid), 0, fmt.Sprintf(`Approved your post <a href="/section/%s/%d/%s">%s</a>`, section, pid, title, title))
+				if err != nil {
+					logger.Error().Err(err).Msg("")
+				}
+			}
+		}
+	}
+}
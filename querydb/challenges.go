@@ -0,0 +1,20 @@
+package querydb
+
+import (
+	"context"
+	"time"
+)
+
+// UseChallenge records a solved proof of work challenge, false means it was used before
+func UseChallenge(challenge string, expiry time.Time) (bool, error) {
+	tag, err := dbpool.Exec(context.Background(), "INSERT INTO used_challenges (challenge, expires) VALUES ($1, $2) ON CONFLICT (challenge) DO NOTHING", challenge, expiry)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+func PurgeChallenges(now time.Time) error {
+	_, err := dbpool.Exec(context.Background(), "DELETE FROM used_challenges WHERE expires < $1", now)
+	return err
+}
@@ -0,0 +1,136 @@
+package querydb
+
+import (
+	"context"
+
+	"github.com/0sm1les/gopherbb/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func SiteStats() (models.SiteStats, error) {
+	var stats models.SiteStats
+	err := dbpool.QueryRow(context.Background(), "SELECT"+
+		" (SELECT COUNT(*) FROM users WHERE status = 'active'),"+
+		" (SELECT COUNT(*) FROM users WHERE status = 'pending'),"+
+		" (SELECT COUNT(*) FROM posts WHERE status = 'posted'),"+
+		" (SELECT COUNT(*) FROM comments WHERE status = 'posted'),"+
+		" (SELECT COUNT(*) FROM likes),"+
+		" (SELECT COUNT(*) FROM posts WHERE status = 'posted' AND time_posted > NOW() - interval '1 day'),"+
+		" (SELECT COUNT(*) FROM comments WHERE status = 'posted' AND time_posted > NOW() - interval '1 day'),"+
+		" (SELECT COUNT(DISTINCT (target_type, target_id)) FROM reports WHERE status = 'open'),"+
+		" (SELECT COUNT(DISTINCT uid) FROM sanctions WHERE lifted IS NULL AND (expires IS NULL OR expires > NOW()))").Scan(&stats.Users,
+		&stats.Pending_users,
+		&stats.Posts,
+		&stats.Comments,
+		&stats.Likes,
+		&stats.Posts_today,
+		&stats.Comments_today,
+		&stats.Open_reports,
+		&stats.Sanctioned)
+	return stats, err
+}
+
+func scanUserSummaries(results pgx.Rows) ([]models.UserSummary, error) {
+	var users []models.UserSummary
+	for results.Next() {
+		var user models.UserSummary
+		err := results.Scan(&user.Id, &user.Username, &user.Role, &user.Status, &user.Date_joined)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// RecentUsers returns the newest registrations whatever their status
+func RecentUsers(limit int) ([]models.UserSummary, error) {
+	results, err := dbpool.Query(context.Background(), "SELECT id, username, role, status, date_joined FROM users ORDER BY id DESC LIMIT $1", limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanUserSummaries(results)
+}
+
+// SearchUsers matches usernames containing query, ignoring case
+func SearchUsers(query string, limit int) ([]models.UserSummary, error) {
+	results, err := dbpool.Query(context.Background(), "SELECT id, username, role, status, date_joined FROM users WHERE strpos(lower(username), lower($1)) > 0"+
+		" ORDER BY length(username), username LIMIT $2", query, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanUserSummaries(results)
+}
+
+// SetRole changes the user's role, the caller validates the role
+func SetRole(user_id int32, role string, audit *models.ModAction) (bool, error) {
+	err := audited(audit, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(context.Background(), "UPDATE users SET role = $1 WHERE id = $2 AND role <> $1", role, user_id)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err == errUnchanged {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// RecentContent returns the newest posts and comments including hidden and deleted ones, drafts are left out
+func RecentContent(limit int) ([]models.ContentListing, error) {
+	var content []models.ContentListing
+	results, err := dbpool.Query(context.Background(), "SELECT 'post', id, poster, id, section, title, status, time_posted FROM posts WHERE status <> $1"+
+		" UNION ALL SELECT 'comment', c.id, c.poster, p.id, p.section, p.title, c.status, c.time_posted FROM comments c INNER JOIN posts p ON p.id = c.parent_post"+
+		" ORDER BY time_posted DESC LIMIT $2", "draft", limit)
+	if err != nil {
+		return nil, err
+	}
+	for results.Next() {
+		var listing models.ContentListing
+		err = results.Scan(&listing.Target_type,
+			&listing.Id,
+			&listing.Poster,
+			&listing.Pid,
+			&listing.Section,
+			&listing.Title,
+			&listing.Status,
+			&listing.Time_posted)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, listing)
+	}
+	return content, nil
+}
+
+// ActiveSanctions returns the sanctions in effect, newest first
+func ActiveSanctions() ([]models.Sanction, error) {
+	var sanctions []models.Sanction
+	results, err := dbpool.Query(context.Background(), "SELECT s.id, s.uid, u.username, s.kind, s.reason, c.username, s.created, s.expires FROM sanctions s"+
+		" INNER JOIN users u ON u.id = s.uid INNER JOIN users c ON c.id = s.created_by"+
+		" WHERE s.lifted IS NULL AND (s.expires IS NULL OR s.expires > NOW()) ORDER BY s.id DESC")
+	if err != nil {
+		return nil, err
+	}
+	for results.Next() {
+		sanction := models.Sanction{Active: true}
+		err = results.Scan(&sanction.Id,
+			&sanction.Uid,
+			&sanction.Username,
+			&sanction.Kind,
+			&sanction.Reason,
+			&sanction.Created_by,
+			&sanction.Created,
+			&sanction.Expires)
+		if err != nil {
+			return nil, err
+		}
+		sanctions = append(sanctions, sanction)
+	}
+	return sanctions, nil
+}
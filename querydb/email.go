@@ -0,0 +1,105 @@
+package querydb
+
+import (
+	"context"
+	"errors"
+
+	"github.com/0sm1les/gopherbb/models"
+)
+
+var ErrInvalidVerification = errors.New("verification link is invalid, expired or already used")
+
+// sets a new unverified email and creates the token that verifies it
+func SetEmail(user_id int32, email string, token_hash string, lifetime int64) error {
+	tx, err := dbpool.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(), "UPDATE users SET email = $1, email_verified = false WHERE id = $2", email, user_id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(context.Background(), "UPDATE email_verifications SET used = true WHERE uid = $1", user_id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(context.Background(), "INSERT INTO email_verifications (uid, email, token, expires) VALUES ($1, $2, $3, NOW() + $4::bigint * interval '1 second')",
+		user_id,
+		email,
+		token_hash,
+		lifetime)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// marks the email a token was sent to as verified, as long as it is still the user's email
+func VerifyEmail(token_hash string) (int32, error) {
+	var user_id int32
+	var email string
+	err := dbpool.QueryRow(context.Background(), "UPDATE email_verifications SET used = true WHERE token = $1 AND used = false AND expires > NOW() RETURNING uid, email", token_hash).Scan(&user_id, &email)
+	if err != nil {
+		if err.Error() == "no rows in result set" {
+			return -1, ErrInvalidVerification
+		}
+		return -1, err
+	}
+	tag, err := dbpool.Exec(context.Background(), "UPDATE users SET email_verified = true WHERE id = $1 AND email = $2", user_id, email)
+	if err != nil {
+		return -1, err
+	}
+	if tag.RowsAffected() != 1 {
+		return -1, ErrInvalidVerification
+	}
+	return user_id, nil
+}
+
+func SetEmailDigest(user_id int32, enabled bool) error {
+	_, err := dbpool.Exec(context.Background(), "UPDATE users SET email_digest = $1 WHERE id = $2", enabled, user_id)
+	return err
+}
+
+// users with a verified email that opted into digests and have unread
+// notifications newer than the last digest
+func DigestUsers() ([]models.User, error) {
+	var users []models.User
+	results, err := dbpool.Query(context.Background(), "SELECT u.id, u.username, u.email FROM users u WHERE u.email_digest = true AND u.email_verified = true"+
+		" AND EXISTS (SELECT 1 FROM notifications n WHERE n.to_uid = u.id AND n.read = false AND n.id > u.digest_nid)")
+	if err != nil {
+		return nil, err
+	}
+	for results.Next() {
+		var user models.User
+		if err := results.Scan(&user.Id, &user.Username, &user.Email); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// unread notifications that have not been in a digest yet
+func DigestNotifications(user_id int32) ([]models.Notification, error) {
+	var notifications []models.Notification
+	results, err := dbpool.Query(context.Background(), "SELECT n.id, n.from_uid, n.msg FROM notifications n INNER JOIN users u ON u.id = n.to_uid"+
+		" WHERE n.to_uid = $1 AND n.read = false AND n.id > u.digest_nid ORDER BY n.id", user_id)
+	if err != nil {
+		return nil, err
+	}
+	for results.Next() {
+		var notification models.Notification
+		if err := results.Scan(&notification.Nid, &notification.From_Uid, &notification.Message); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, notification)
+	}
+	return notifications, nil
+}
+
+func SetDigestNid(user_id int32, nid int32) error {
+	_, err := dbpool.Exec(context.Background(), "UPDATE users SET digest_nid = $1 WHERE id = $2", nid, user_id)
+	return err
+}
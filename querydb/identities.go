@@ -0,0 +1,71 @@
+package querydb
+
+import (
+	"context"
+
+	"github.com/0sm1les/gopherbb/models"
+)
+
+// returns the user an external identity is linked to, -1 if there is none
+func IdentityUser(provider string, subject string) (int32, error) {
+	var user_id int32
+	err := dbpool.QueryRow(context.Background(), "SELECT uid FROM identities WHERE provider = $1 AND subject = $2", provider, subject).Scan(&user_id)
+	if err != nil {
+		if err.Error() == "no rows in result set" {
+			return -1, nil
+		}
+		return -1, err
+	}
+	return user_id, nil
+}
+
+func UserIdentities(user_id int32) ([]models.Identity, error) {
+	var identities []models.Identity
+	results, err := dbpool.Query(context.Background(), "SELECT provider, subject, linked FROM identities WHERE uid = $1 ORDER BY provider", user_id)
+	if err != nil {
+		return nil, err
+	}
+	for results.Next() {
+		var identity models.Identity
+		if err := results.Scan(&identity.Provider, &identity.Subject, &identity.Linked); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, nil
+}
+
+func LinkIdentity(user_id int32, provider string, subject string) error {
+	_, err := dbpool.Exec(context.Background(), "INSERT INTO identities (uid, provider, subject, linked) VALUES ($1, $2, $3, NOW())", user_id, provider, subject)
+	return err
+}
+
+func UnlinkIdentity(user_id int32, provider string) error {
+	_, err := dbpool.Exec(context.Background(), "DELETE FROM identities WHERE uid = $1 AND provider = $2", user_id, provider)
+	return err
+}
+
+// creates a user with status and without a password that signs in through
+// provider. email is stored as verified since the provider vouched for it.
+func CreateIdentityUser(user models.Username, status string, provider string, subject string, email string) (int32, error) {
+	tx, err := dbpool.Begin(context.Background())
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var user_id int32
+	err = tx.QueryRow(context.Background(), "INSERT INTO users (username, password, status, email, email_verified, date_joined) VALUES ($1, '', $2, $3, $4, NOW()) RETURNING id",
+		user,
+		status,
+		email,
+		email != "").Scan(&user_id)
+	if err != nil {
+		return -1, err
+	}
+	_, err = tx.Exec(context.Background(), "INSERT INTO identities (uid, provider, subject, linked) VALUES ($1, $2, $3, NOW())", user_id, provider, subject)
+	if err != nil {
+		return -1, err
+	}
+	return user_id, tx.Commit(context.Background())
+}
@@ -0,0 +1,98 @@
+package querydb
+
+import (
+	"context"
+	"errors"
+
+	"github.com/0sm1les/gopherbb/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrInvalidInvite = errors.New("invite code is invalid, expired or used up")
+
+func NewInvite(user_id int32, code_hash string, max_uses int32, lifetime int64) error {
+	_, err := dbpool.Exec(context.Background(), "INSERT INTO invites (code, created_by, max_uses, created, expires) VALUES ($1, $2, $3, NOW(), NOW() + $4::bigint * interval '1 second')",
+		code_hash,
+		user_id,
+		max_uses,
+		lifetime)
+	return err
+}
+
+func UserInvites(user_id int32) ([]models.Invite, error) {
+	var invites []models.Invite
+	results, err := dbpool.Query(context.Background(), "SELECT id, created_by, max_uses, uses, created, expires FROM invites WHERE created_by = $1 ORDER BY id DESC", user_id)
+	if err != nil {
+		return nil, err
+	}
+	for results.Next() {
+		var invite models.Invite
+		err = results.Scan(&invite.Id, &invite.Created_by, &invite.Max_uses, &invite.Uses, &invite.Created, &invite.Expires)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	return invites, nil
+}
+
+// uses up one invite and creates the user in the same transaction so a
+// failed insert does not burn the invite
+func CreateInvitedUser(user models.Username, hash models.Hash, status string, code_hash string) error {
+	tx, err := dbpool.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	var inviter int32
+	err = tx.QueryRow(context.Background(), "UPDATE invites SET uses = uses + 1 WHERE code = $1 AND uses < max_uses AND expires > NOW() RETURNING created_by", code_hash).Scan(&inviter)
+	if err != nil {
+		if err.Error() == "no rows in result set" {
+			return ErrInvalidInvite
+		}
+		return err
+	}
+
+	_, err = tx.Exec(context.Background(), "INSERT INTO users (username, password, status, invited_by, date_joined) VALUES ($1, $2, $3, $4, NOW())", user, hash, status, inviter)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+func PendingUsers() ([]models.User, error) {
+	var users []models.User
+	results, err := dbpool.Query(context.Background(), "SELECT id, username, date_joined FROM users WHERE status = $1 ORDER BY id", "pending")
+	if err != nil {
+		return nil, err
+	}
+	for results.Next() {
+		var user models.User
+		err = results.Scan(&user.Id, &user.Username, &user.Date_Joined)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// only changes users that are still pending so a decision can't be applied twice
+func SetPendingUserStatus(user_id int32, status string, audit *models.ModAction) (bool, error) {
+	err := audited(audit, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(context.Background(), "UPDATE users SET status = $1 WHERE id = $2 AND status = $3", status, user_id, "pending")
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() != 1 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err == errUnchanged {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,131 @@
+package querydb
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/0sm1les/gopherbb/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// errUnchanged rolls back an audited change that matched no rows so nothing is logged
+var errUnchanged = errors.New("nothing changed")
+
+// snapshots select what the audit log keeps of each kind of target
+var snapshots = map[string]string{
+	"post":    "SELECT jsonb_build_object('status', status, 'section', section, 'title', title, 'locked', locked, 'pinned', pinned, 'md', md) FROM posts WHERE id = $1",
+	"comment": "SELECT jsonb_build_object('status', status, 'md', md) FROM comments WHERE id = $1",
+	"user": "SELECT jsonb_build_object('role', role, 'status', status, 'sanctions', (SELECT COALESCE(jsonb_agg(jsonb_build_object('id', s.id, 'kind', s.kind, 'expires', s.expires) ORDER BY s.id), '[]')" +
+		" FROM sanctions s WHERE s.uid = users.id AND s.lifted IS NULL AND (s.expires IS NULL OR s.expires > NOW()))) FROM users WHERE id = $1",
+}
+
+// snapshot returns the audited target as json, or nil when there is nothing to audit
+func snapshot(tx pgx.Tx, audit *models.ModAction) ([]byte, error) {
+	if audit == nil {
+		return nil, nil
+	}
+	var row []byte
+	err := tx.QueryRow(context.Background(), snapshots[audit.Target_type], audit.Target_id).Scan(&row)
+	if err != nil && err.Error() != "no rows in result set" {
+		return nil, err
+	}
+	return row, nil
+}
+
+// record appends audit to mod_actions in tx with the target as it was before
+// and as it is now. A nil audit records nothing.
+func record(tx pgx.Tx, audit *models.ModAction, before []byte) error {
+	if audit == nil {
+		return nil
+	}
+	after, err := snapshot(tx, audit)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(context.Background(), "INSERT INTO mod_actions (actor, action, target_type, target_id, reason, before, after, time) VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())",
+		audit.Actor,
+		audit.Action,
+		audit.Target_type,
+		audit.Target_id,
+		audit.Reason,
+		before,
+		after)
+	return err
+}
+
+// audited runs change in a transaction that also records audit
+func audited(audit *models.ModAction, change func(tx pgx.Tx) error) error {
+	tx, err := dbpool.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	before, err := snapshot(tx, audit)
+	if err != nil {
+		return err
+	}
+	if err := change(tx); err != nil {
+		return err
+	}
+	if err := record(tx, audit, before); err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// ModActions returns the newest actions matching filter, zero values match everything
+func ModActions(filter models.ModActionFilter, limit int) ([]models.ModAction, error) {
+	var actions []models.ModAction
+	qry := "SELECT m.id, m.actor, u.username, m.action, m.target_type, m.target_id, m.reason, m.before, m.after, m.time FROM mod_actions m INNER JOIN users u ON u.id = m.actor WHERE true"
+	var args []any
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		qry += " AND " + condition + " $" + strconv.Itoa(len(args))
+	}
+	if filter.Actor != "" {
+		where("u.username =", filter.Actor)
+	}
+	if filter.Action != "" {
+		where("m.action =", filter.Action)
+	}
+	if filter.Target_type != "" {
+		where("m.target_type =", filter.Target_type)
+	}
+	if filter.Target_id != 0 {
+		where("m.target_id =", filter.Target_id)
+	}
+	if !filter.Since.IsZero() {
+		where("m.time >=", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		where("m.time <", filter.Until)
+	}
+	args = append(args, limit)
+	qry += " ORDER BY m.id DESC LIMIT $" + strconv.Itoa(len(args))
+
+	results, err := dbpool.Query(context.Background(), qry, args...)
+	if err != nil {
+		return nil, err
+	}
+	for results.Next() {
+		var action models.ModAction
+		err = results.Scan(&action.Id,
+			&action.Actor,
+			&action.Actor_name,
+			&action.Action,
+			&action.Target_type,
+			&action.Target_id,
+			&action.Reason,
+			&action.Before,
+			&action.After,
+			&action.Time)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
@@ -0,0 +1,67 @@
+package querydb
+
+import (
+	"context"
+	"errors"
+
+	"github.com/0sm1les/gopherbb/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrInvalidReset = errors.New("reset link is invalid, expired or already used")
+
+// audit is set when a mod creates the link and nil when users ask for their own
+func NewPasswordReset(user_id int32, created_by int32, token_hash string, lifetime int64, audit *models.ModAction) error {
+	return audited(audit, func(tx pgx.Tx) error {
+		_, err := tx.Exec(context.Background(), "INSERT INTO password_resets (uid, token, created_by, created, expires) VALUES ($1, $2, $3, NOW(), NOW() + $4::bigint * interval '1 second')",
+			user_id,
+			token_hash,
+			created_by,
+			lifetime)
+		return err
+	})
+}
+
+// returns the user a reset token belongs to if it can still be used
+func PasswordResetUser(token_hash string) (int32, error) {
+	var user_id int32
+	err := dbpool.QueryRow(context.Background(), "SELECT uid FROM password_resets WHERE token = $1 AND used = false AND expires > NOW()", token_hash).Scan(&user_id)
+	if err != nil {
+		if err.Error() == "no rows in result set" {
+			return -1, ErrInvalidReset
+		}
+		return -1, err
+	}
+	return user_id, nil
+}
+
+// uses a reset token, sets the new password and ends every session and other
+// outstanding reset for the user in one transaction
+func ResetPassword(token_hash string, hash models.Hash) (int32, error) {
+	tx, err := dbpool.Begin(context.Background())
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var user_id int32
+	err = tx.QueryRow(context.Background(), "UPDATE password_resets SET used = true WHERE token = $1 AND used = false AND expires > NOW() RETURNING uid", token_hash).Scan(&user_id)
+	if err != nil {
+		if err.Error() == "no rows in result set" {
+			return -1, ErrInvalidReset
+		}
+		return -1, err
+	}
+
+	if _, err = tx.Exec(context.Background(), "UPDATE users SET password = $1 WHERE id = $2", hash, user_id); err != nil {
+		return -1, err
+	}
+	if _, err = tx.Exec(context.Background(), "UPDATE password_resets SET used = true WHERE uid = $1", user_id); err != nil {
+		return -1, err
+	}
+	if _, err = tx.Exec(context.Background(), "DELETE FROM sessions WHERE uid = $1", user_id); err != nil {
+		return -1, err
+	}
+	return user_id, tx.Commit(context.Background())
+}
@@ -0,0 +1,92 @@
+package querydb
+
+import (
+	"context"
+
+	"github.com/0sm1les/gopherbb/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// PromotionCandidates returns active unranked users without sanctions that meet every threshold.
+// Likes only count when they come from someone else.
+func PromotionCandidates(min_age int64, min_posts int, min_comments int, min_likes int) ([]int32, error) {
+	var uids []int32
+	results, err := dbpool.Query(context.Background(), "SELECT u.id FROM users u WHERE u.role = $1 AND u.status = $2"+
+		" AND u.date_joined <= NOW() - $3::bigint * interval '1 second'"+
+		" AND NOT EXISTS (SELECT 1 FROM sanctions s WHERE s.uid = u.id AND s.lifted IS NULL AND (s.expires IS NULL OR s.expires > NOW()))"+
+		" AND (SELECT COUNT(*) FROM posts p WHERE p.poster = u.id AND p.status = $4) >= $5"+
+		" AND (SELECT COUNT(*) FROM comments c WHERE c.poster = u.id AND c.status = $4) >= $6"+
+		" AND (SELECT COUNT(*) FROM likes l INNER JOIN posts p ON p.id = l.post WHERE p.poster = u.id AND l.liked_by <> u.id) >= $7",
+		"unranked", "active", min_age, "posted", min_posts, min_comments, min_likes)
+	if err != nil {
+		return nil, err
+	}
+	for results.Next() {
+		var uid int32
+		if err := results.Scan(&uid); err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+	return uids, nil
+}
+
+// only promotes users that are still unranked so a role set by an admin is kept
+func Promote(user_id int32) (bool, error) {
+	tag, err := dbpool.Exec(context.Background(), "UPDATE users SET role = $1 WHERE id = $2 AND role = $3", "ranked", user_id, "unranked")
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// PostedWithin reports whether the user published a post or comment in the last seconds
+func PostedWithin(user_id int32, seconds int64) (bool, error) {
+	var posted bool
+	err := dbpool.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM posts WHERE poster = $1 AND status <> $2 AND time_posted > NOW() - $3::bigint * interval '1 second')"+
+		" OR EXISTS (SELECT 1 FROM comments WHERE poster = $1 AND time_posted > NOW() - $3::bigint * interval '1 second')",
+		user_id, "draft", seconds).Scan(&posted)
+	return posted, err
+}
+
+func PostedCount(user_id int32) (int, error) {
+	var count int
+	err := dbpool.QueryRow(context.Background(), "SELECT COUNT(*) FROM posts WHERE poster = $1 AND status = $2", user_id, "posted").Scan(&count)
+	return count, err
+}
+
+func QueuedPosts() ([]models.PostListing, error) {
+	var posts []models.PostListing
+	results, err := dbpool.Query(context.Background(), "SELECT id, poster, title, section, time_posted FROM posts WHERE status = $1 ORDER BY id", "queued")
+	if err != nil {
+		return nil, err
+	}
+	for results.Next() {
+		var post models.PostListing
+		err = results.Scan(&post.Pid, &post.Uid, &post.Title, &post.Section, &post.Time_posted)
+		if err != nil {
+			return nil, err
+		}
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
+
+// only changes posts that are still queued so a decision can't be applied twice
+func SetQueuedPostStatus(post_id int32, status string, audit *models.ModAction) (bool, error) {
+	err := audited(audit, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(context.Background(), "UPDATE posts SET status = $1 WHERE id = $2 AND status = $3", status, post_id, "queued")
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() != 1 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err == errUnchanged {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -2,10 +2,12 @@ package querydb
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/0sm1les/gopherbb/models"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -30,25 +32,34 @@ func UserExists(username models.Username) int32 {
 	return user_id
 }
 
-func CreateUser(user models.Username, hash models.Hash) error {
-	_, err := dbpool.Exec(context.Background(), "INSERT INTO users (username, password, date_joined) VALUES ($1, $2, NOW())", user, hash)
+// status is active, or pending when registrations need approval
+func CreateUser(user models.Username, hash models.Hash, status string) error {
+	_, err := dbpool.Exec(context.Background(), "INSERT INTO users (username, password, status, date_joined) VALUES ($1, $2, $3, NOW())", user, hash, status)
 	return err
 }
 
-func Authenticate(user models.Username, hash models.Hash) (int32, error) {
+// returns user id and stored password hash, the hash is compared by the caller
+func Authenticate(user models.Username) (int32, models.Hash, error) {
 	var user_id int32
-	err := dbpool.QueryRow(context.Background(), "SELECT id FROM users WHERE username = $1 AND password = $2", user, hash).Scan(&user_id)
+	var hash models.Hash
+	err := dbpool.QueryRow(context.Background(), "SELECT id, password FROM users WHERE username = $1", user).Scan(&user_id, &hash)
 	if err != nil {
-		return -1, err
+		return -1, "", err
 	}
-	return user_id, nil
+	return user_id, hash, nil
+}
+
+func SetPassword(user_id int32, hash models.Hash) error {
+	_, err := dbpool.Exec(context.Background(), "UPDATE users SET password = $1 WHERE id = $2", hash, user_id)
+	return err
 }
 
 func Userinfo(user_id int32) (models.User, error) {
 	var userinfo models.User
 
 	err := dbpool.QueryRow(context.Background(), "SELECT id, role, profile_pic, username ,password, bio, user_fg_color, user_bg_color,"+
-		" custom_primary_text_color, custom_secondary_text_color, custom_background_color, custom_border_color, date_joined FROM users WHERE id = $1", user_id).Scan(
+		" custom_primary_text_color, custom_secondary_text_color, custom_background_color, custom_border_color, date_joined, totp_enabled, status,"+
+		" email, email_verified, email_digest FROM users WHERE id = $1", user_id).Scan(
 		&userinfo.Id,
 		&userinfo.Role,
 		&userinfo.Profile_pic,
@@ -62,6 +73,11 @@ func Userinfo(user_id int32) (models.User, error) {
 		&userinfo.Theme.Background,
 		&userinfo.Theme.Border,
 		&userinfo.Date_Joined,
+		&userinfo.Totp_enabled,
+		&userinfo.Status,
+		&userinfo.Email,
+		&userinfo.Email_verified,
+		&userinfo.Email_digest,
 	)
 	if err != nil {
 		return userinfo, err
@@ -122,7 +138,7 @@ func NewPost(user_id int32, section string, status string, title string, md stri
 
 func GetPost(post_id int32) (models.Post, error) {
 	var post models.Post
-	err := dbpool.QueryRow(context.Background(), "SELECT id, poster, status, title, section, md, html, time_posted FROM posts WHERE id = $1",
+	err := dbpool.QueryRow(context.Background(), "SELECT id, poster, status, title, section, md, html, time_posted, locked, pinned FROM posts WHERE id = $1",
 		post_id).Scan(&post.Pid,
 		&post.Uid,
 		&post.Status,
@@ -130,23 +146,27 @@ func GetPost(post_id int32) (models.Post, error) {
 		&post.Section,
 		&post.Md,
 		&post.Html,
-		&post.Time_posted)
+		&post.Time_posted,
+		&post.Locked,
+		&post.Pinned)
 	return post, err
 }
 
 func GetPostMD(post_id int32) (models.Post, error) {
 	var post models.Post
-	err := dbpool.QueryRow(context.Background(), "SELECT id, poster, title, time_posted, md FROM posts WHERE id = $1", post_id).Scan(&post.Pid,
+	err := dbpool.QueryRow(context.Background(), "SELECT id, poster, title, section, time_posted, md FROM posts WHERE id = $1", post_id).Scan(&post.Pid,
 		&post.Uid,
 		&post.Title,
+		&post.Section,
 		&post.Time_posted,
 		&post.Md)
 	return post, err
 }
 
-func UserPosts(user_id int32, status string) ([]models.PostListing, error) {
+// only posts in the visible sections are listed
+func UserPosts(user_id int32, status string, visible []string) ([]models.PostListing, error) {
 	var posts []models.PostListing
-	results, err := dbpool.Query(context.Background(), "SELECT id, title, section,time_posted FROM posts WHERE poster = $1 AND status = $2 ORDER BY id DESC", user_id, status)
+	results, err := dbpool.Query(context.Background(), "SELECT id, title, section,time_posted FROM posts WHERE poster = $1 AND status = $2 AND section = ANY($3) ORDER BY id DESC", user_id, status, visible)
 	if err != nil {
 		return nil, err
 	}
@@ -161,9 +181,9 @@ func UserPosts(user_id int32, status string) ([]models.PostListing, error) {
 	return posts, nil
 }
 
-func RecentUserPosts(user_id int32) ([]models.PostListing, error) {
+func RecentUserPosts(user_id int32, visible []string) ([]models.PostListing, error) {
 	var posts []models.PostListing
-	results, err := dbpool.Query(context.Background(), "SELECT id, title, section,time_posted FROM posts WHERE poster = $1 AND status = $2 ORDER BY time_posted DESC LIMIT 4", user_id, "posted")
+	results, err := dbpool.Query(context.Background(), "SELECT id, title, section,time_posted FROM posts WHERE poster = $1 AND status = $2 AND section = ANY($3) ORDER BY time_posted DESC LIMIT 4", user_id, "posted", visible)
 	if err != nil {
 		return nil, err
 	}
@@ -178,14 +198,17 @@ func RecentUserPosts(user_id int32) ([]models.PostListing, error) {
 	return posts, nil
 }
 
-func UpdatePost(post_id int32, title string, md string, html string, section string) error {
-	_, err := dbpool.Exec(context.Background(), "UPDATE posts SET title = $1, md = $2, html = $3, section = $4 WHERE id = $5",
-		title,
-		md,
-		html,
-		section,
-		post_id)
-	return err
+// audit is set when a mod edits someone else's post and nil otherwise
+func UpdatePost(post_id int32, title string, md string, html string, section string, audit *models.ModAction) error {
+	return audited(audit, func(tx pgx.Tx) error {
+		_, err := tx.Exec(context.Background(), "UPDATE posts SET title = $1, md = $2, html = $3, section = $4 WHERE id = $5",
+			title,
+			md,
+			html,
+			section,
+			post_id)
+		return err
+	})
 }
 
 func UpdatePostStatus(post_id int32, status string) error {
@@ -195,13 +218,13 @@ func UpdatePostStatus(post_id int32, status string) error {
 
 func GetSectionPosts(section string) ([]models.PostListing, error) {
 	var posts []models.PostListing
-	results, err := dbpool.Query(context.Background(), "SELECT id, poster, title, time_posted FROM posts WHERE status = $1 AND section = $2 ORDER BY id DESC", "posted", section)
+	results, err := dbpool.Query(context.Background(), "SELECT id, poster, title, time_posted, pinned FROM posts WHERE status = $1 AND section = $2 ORDER BY pinned DESC, id DESC", "posted", section)
 	if err != nil {
 		return nil, err
 	}
 	for results.Next() {
 		var post models.PostListing
-		err = results.Scan(&post.Pid, &post.Uid, &post.Title, &post.Time_posted)
+		err = results.Scan(&post.Pid, &post.Uid, &post.Title, &post.Time_posted, &post.Pinned)
 		if err != nil {
 			return nil, err
 		}
@@ -219,35 +242,51 @@ func GetUser(user_id int32) (models.Userlisted, error) {
 	return user, err
 }
 
-func PostComment(user_id int32, parent_post int32, comment_post int32, md string, html string) (int32, error) {
+// ErrInvalidParent is returned when replying to a comment that isn't posted on the same post
+var ErrInvalidParent = errors.New("the comment you replied to is gone")
+
+// PostComment adds a comment to parent_post, replying to parent_comment unless it is 0
+func PostComment(user_id int32, parent_post int32, parent_comment int32, md string, html string) (int32, error) {
 	var comment_id int32
-	var err error
-	if comment_id != -1 {
-		err = dbpool.QueryRow(context.Background(), "INSERT into comments (poster, parent_post, parent_comment, md, html, time_posted) VALUES ($1, $2, $3, $4, $5, NOW()) RETURNING id",
-			user_id,
-			parent_post,
-			comment_post,
-			md,
-			html).Scan(&comment_id)
-	} else if comment_id == -1 {
-		err = dbpool.QueryRow(context.Background(), "INSERT into comments (poster, parent_post, md, html, time_posted) VALUES ($1, $2, $3, $4, $5, NOW()) RETURNING id",
+	if parent_comment == 0 {
+		err := dbpool.QueryRow(context.Background(), "INSERT into comments (poster, parent_post, md, html, time_posted) VALUES ($1, $2, $3, $4, NOW()) RETURNING id",
 			user_id,
 			parent_post,
 			md,
 			html).Scan(&comment_id)
+		return comment_id, err
+	}
+	// the parent is checked in the insert so it can't be deleted in between
+	err := dbpool.QueryRow(context.Background(), "INSERT into comments (poster, parent_post, parent_comment, md, html, time_posted)"+
+		" SELECT $1, parent_post, id, $4, $5, NOW() FROM comments WHERE id = $3 AND parent_post = $2 AND status = $6 RETURNING id",
+		user_id,
+		parent_post,
+		parent_comment,
+		md,
+		html,
+		"posted").Scan(&comment_id)
+	if err != nil && err.Error() == "no rows in result set" {
+		return 0, ErrInvalidParent
 	}
 	return comment_id, err
 }
 
-func GetComments(post_id int32) ([]models.Comment, error) {
+// GetComments returns every comment on a post oldest first with its likes and whether
+// viewer liked it. Comments that aren't posted come without their html, they are only
+// kept as placeholders for their replies.
+func GetComments(post_id int32, viewer int32) ([]models.Comment, error) {
 	var comments []models.Comment
-	results, err := dbpool.Query(context.Background(), "SELECT id, poster, parent_post, parent_comment, html, time_posted FROM comments WHERE parent_post = $1 AND status = $2", post_id, "posted")
+	results, err := dbpool.Query(context.Background(), "SELECT c.id, c.poster, c.parent_post, c.parent_comment, c.status,"+
+		" CASE WHEN c.status = $2 THEN c.html ELSE '' END, c.time_posted, c.edited,"+
+		" (SELECT COUNT(*) FROM comment_likes l WHERE l.comment = c.id),"+
+		" EXISTS (SELECT 1 FROM comment_likes l WHERE l.comment = c.id AND l.liked_by = $3)"+
+		" FROM comments c WHERE c.parent_post = $1 ORDER BY c.time_posted, c.id", post_id, "posted", viewer)
 	if err != nil {
 		return nil, err
 	}
 	for results.Next() {
 		var comment models.Comment
-		err = results.Scan(&comment.Cid, &comment.User_id, &comment.Parent_post, &comment.Comment_post, &comment.Html, &comment.Time_posted)
+		err = results.Scan(&comment.Cid, &comment.User_id, &comment.Parent_post, &comment.Parent_comment, &comment.Status, &comment.Html, &comment.Time_posted, &comment.Edited, &comment.Likes, &comment.Liked)
 		if err != nil {
 			return nil, err
 		}
@@ -256,6 +295,25 @@ func GetComments(post_id int32) ([]models.Comment, error) {
 	return comments, nil
 }
 
+// LikeUnlikeComment toggles whether user_id likes a comment, it returns whether they
+// like it now and how many likes it has
+func LikeUnlikeComment(user_id int32, comment_id int32) (bool, int, error) {
+	tag, err := dbpool.Exec(context.Background(), "DELETE FROM comment_likes WHERE liked_by = $1 AND comment = $2", user_id, comment_id)
+	if err != nil {
+		return false, 0, err
+	}
+	liked := tag.RowsAffected() == 0
+	if liked {
+		_, err = dbpool.Exec(context.Background(), "INSERT INTO comment_likes (comment, liked_by, time_liked) VALUES ($1, $2, NOW()) ON CONFLICT DO NOTHING", comment_id, user_id)
+		if err != nil {
+			return false, 0, err
+		}
+	}
+	var count int
+	err = dbpool.QueryRow(context.Background(), "SELECT COUNT(*) FROM comment_likes WHERE comment = $1", comment_id).Scan(&count)
+	return liked, count, err
+}
+
 func LikeUnlike(user_id int32, post_id int32) error {
 	var check int32
 	err := dbpool.QueryRow(context.Background(), "SELECT id FROM likes WHERE liked_by = $1 AND post = $2", user_id, post_id).Scan(&check)
@@ -286,9 +344,9 @@ func Liked(user_id int32, post_id int32) (bool, error) {
 	return false, nil
 }
 
-func Likes(user_id int32) ([]models.PostListing, error) {
+func Likes(user_id int32, visible []string) ([]models.PostListing, error) {
 	var posts []models.PostListing
-	results, err := dbpool.Query(context.Background(), "SELECT p.id, p.poster ,p.title, p.section, p.time_posted FROM posts p INNER JOIN likes l ON p.id = l.post WHERE l.liked_by = $1 AND p.status = $2", user_id, "posted")
+	results, err := dbpool.Query(context.Background(), "SELECT p.id, p.poster ,p.title, p.section, p.time_posted FROM posts p INNER JOIN likes l ON p.id = l.post WHERE l.liked_by = $1 AND p.status = $2 AND p.section = ANY($3)", user_id, "posted", visible)
 	if err != nil {
 		return nil, err
 	}
@@ -311,6 +369,13 @@ func GetPostOP(pid int32) (int32, string, string, error) {
 	return uid, section, title, err
 }
 
+// CommentOnPost reports whether cid is a posted comment on post_id
+func CommentOnPost(cid int32, post_id int32) (bool, error) {
+	var found bool
+	err := dbpool.QueryRow(context.Background(), "SELECT EXISTS (SELECT 1 FROM comments WHERE id = $1 AND parent_post = $2 AND status = $3)", cid, post_id, "posted").Scan(&found)
+	return found, err
+}
+
 func GetCommentPoster(cid int32) (int32, error) {
 	var uid int32
 	err := dbpool.QueryRow(context.Background(), "SELECT poster FROM comments WHERE id = $1", cid).Scan(&uid)
@@ -322,6 +387,18 @@ func NewNotification(to_uid int32, from_uid int32, message string) error {
 	return err
 }
 
+// NewPostNotification is a notification about a post, or a comment on it when comment_id
+// isn't 0, that is removed when the content is purged
+func NewPostNotification(to_uid int32, from_uid int32, post_id int32, comment_id int32, message string) error {
+	_, err := dbpool.Exec(context.Background(), "INSERT INTO notifications (to_uid, from_uid, msg, post, comment) VALUES ($1, $2, $3, $4, NULLIF($5, 0))",
+		to_uid,
+		from_uid,
+		message,
+		post_id,
+		comment_id)
+	return err
+}
+
 func Notifications(user_id int32) ([]models.Notification, error) {
 	var notifications []models.Notification
 	results, err := dbpool.Query(context.Background(), "SELECT id, from_uid, msg FROM notifications WHERE to_uid = $1 AND read = $2", user_id, false)
@@ -339,10 +416,10 @@ func Notifications(user_id int32) ([]models.Notification, error) {
 	return notifications, nil
 }
 
-func Search(search_qry string) ([]models.PostListing, error) {
+func Search(search_qry string, visible []string) ([]models.PostListing, error) {
 	var posts []models.PostListing
 
-	results, err := dbpool.Query(context.Background(), "SELECT  id, poster, title, time_posted FROM posts WHERE ts @@ phraseto_tsquery('english', $1)", search_qry)
+	results, err := dbpool.Query(context.Background(), "SELECT  id, poster, title, time_posted FROM posts WHERE ts @@ phraseto_tsquery('english', $1) AND section = ANY($2)", search_qry, visible)
 	if err != nil {
 		return nil, err
 	}
@@ -357,19 +434,53 @@ func Search(search_qry string) ([]models.PostListing, error) {
 	return posts, nil
 }
 
-func DeletePost(pid int32) error {
-	_, err := dbpool.Exec(context.Background(), "UPDATE posts SET status = $1 WHERE id = $2", "deleted", pid)
-	return err
+func DeletePost(pid int32, deleted_by int32, audit *models.ModAction) error {
+	return audited(audit, func(tx pgx.Tx) error {
+		_, err := tx.Exec(context.Background(), "UPDATE posts SET status = $1, deleted = NOW(), deleted_by = $2, deleted_from = status WHERE id = $3 AND status <> $1",
+			"deleted", deleted_by, pid)
+		return err
+	})
 }
 
-func DeleteReply(cid int32) error {
-	_, err := dbpool.Exec(context.Background(), "UPDATE comments SET status = $1 WHERE id = $2", "deleted", cid)
-	return err
+func DeleteReply(cid int32, deleted_by int32, audit *models.ModAction) error {
+	return audited(audit, func(tx pgx.Tx) error {
+		_, err := tx.Exec(context.Background(), "UPDATE comments SET status = $1, deleted = NOW(), deleted_by = $2, deleted_from = status WHERE id = $3 AND status <> $1",
+			"deleted", deleted_by, cid)
+		return err
+	})
+}
+
+// RestorePost puts a deleted post back the way it was and reports whether it was deleted
+func RestorePost(pid int32, audit *models.ModAction) (bool, error) {
+	return restore("posts", pid, audit)
+}
+
+// RestoreReply puts a deleted comment back the way it was and reports whether it was deleted
+func RestoreReply(cid int32, audit *models.ModAction) (bool, error) {
+	return restore("comments", cid, audit)
+}
+
+func restore(table string, id int32, audit *models.ModAction) (bool, error) {
+	err := audited(audit, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(context.Background(), "UPDATE "+table+" SET status = COALESCE(deleted_from, $1), deleted = NULL, deleted_by = NULL, deleted_from = NULL"+
+			" WHERE id = $2 AND status = $3", "posted", id, "deleted")
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err == errUnchanged {
+		return false, nil
+	}
+	return err == nil, err
 }
 
-func RecentPosts() ([]models.PostListing, error) {
+func RecentPosts(visible []string) ([]models.PostListing, error) {
 	var posts []models.PostListing
-	results, err := dbpool.Query(context.Background(), "SELECT id, poster, title, section, time_posted FROM posts WHERE status = $1 ORDER BY id DESC LIMIT 10", "posted")
+	results, err := dbpool.Query(context.Background(), "SELECT id, poster, title, section, time_posted FROM posts WHERE status = $1 AND section = ANY($2) ORDER BY id DESC LIMIT 10", "posted", visible)
 	if err != nil {
 		return nil, err
 	}
@@ -386,23 +497,23 @@ func RecentPosts() ([]models.PostListing, error) {
 
 func MostLiked(section models.Section) ([]models.PostListing, error) {
 	var posts []models.PostListing
-	stmt := `SELECT posts.id, COALESCE(like_data.like_count, 0) as like_count, posts.title, posts.poster, posts.section, posts.time_posted 
+	stmt := `SELECT posts.id, COALESCE(like_data.like_count, 0) as like_count, posts.title, posts.poster, posts.section, posts.time_posted, posts.pinned
 FROM posts
 LEFT JOIN (
     SELECT post, COUNT(*) AS like_count
     FROM likes
     GROUP BY post
 ) AS like_data
-ON like_data.post = posts.id WHERE section = $1 ORDER BY like_count DESC;`
+ON like_data.post = posts.id WHERE section = $1 AND status = $2 ORDER BY posts.pinned DESC, like_count DESC;`
 
-	results, err := dbpool.Query(context.Background(), stmt, section.Id)
+	results, err := dbpool.Query(context.Background(), stmt, section.Id, "posted")
 	if err != nil {
 		return nil, err
 	}
 	for results.Next() {
 		var post models.PostListing
 		var like_count int
-		err = results.Scan(&post.Pid, &like_count, &post.Title, &post.Uid, &post.Section, &post.Time_posted)
+		err = results.Scan(&post.Pid, &like_count, &post.Title, &post.Uid, &post.Section, &post.Time_posted, &post.Pinned)
 		if err != nil {
 			return nil, err
 		}
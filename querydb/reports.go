@@ -0,0 +1,184 @@
+package querydb
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/0sm1les/gopherbb/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var ErrInvalidReport = errors.New("that post or comment can't be reported")
+
+// reportTables maps a report target to the table holding it
+var reportTables = map[string]string{
+	"post":    "posts",
+	"comment": "comments",
+}
+
+// ReportTarget returns the author of a posted post or comment and the section it is in
+func ReportTarget(target_type string, target_id int32) (int32, string, error) {
+	var author int32
+	var section string
+	var err error
+	switch target_type {
+	case "post":
+		err = dbpool.QueryRow(context.Background(), "SELECT poster, section FROM posts WHERE id = $1 AND status = $2", target_id, "posted").Scan(&author, &section)
+	case "comment":
+		err = dbpool.QueryRow(context.Background(), "SELECT c.poster, p.section FROM comments c INNER JOIN posts p ON p.id = c.parent_post WHERE c.id = $1 AND c.status = $2 AND p.status = $2",
+			target_id, "posted").Scan(&author, &section)
+	default:
+		return 0, "", ErrInvalidReport
+	}
+	if err != nil {
+		if err.Error() == "no rows in result set" {
+			return 0, "", ErrInvalidReport
+		}
+		return 0, "", err
+	}
+	return author, section, nil
+}
+
+// NewReport files a report unless the user already reported the target. Once
+// hide_after open reports come from users above unranked the target is hidden
+// until a mod resolves them, 0 never hides.
+func NewReport(reporter int32, target_type string, target_id int32, category string, note string, hide_after int) (bool, error) {
+	table, ok := reportTables[target_type]
+	if !ok {
+		return false, ErrInvalidReport
+	}
+	tx, err := dbpool.Begin(context.Background())
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(context.Background())
+
+	tag, err := tx.Exec(context.Background(), "INSERT INTO reports (reporter, target_type, target_id, category, note, created) VALUES ($1, $2, $3, $4, $5, NOW())"+
+		" ON CONFLICT (reporter, target_type, target_id) DO NOTHING",
+		reporter,
+		target_type,
+		target_id,
+		category,
+		note)
+	if err != nil {
+		return false, err
+	}
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	if hide_after > 0 {
+		var count int
+		err = tx.QueryRow(context.Background(), "SELECT COUNT(*) FROM reports r INNER JOIN users u ON u.id = r.reporter WHERE r.target_type = $1 AND r.target_id = $2 AND r.status = $3 AND u.role <> $4",
+			target_type, target_id, "open", "unranked").Scan(&count)
+		if err != nil {
+			return false, err
+		}
+		if count >= hide_after {
+			_, err = tx.Exec(context.Background(), "UPDATE "+table+" SET status = $1 WHERE id = $2 AND status = $3", "hidden", target_id, "posted")
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	return true, tx.Commit(context.Background())
+}
+
+// ResolveReports closes the open reports on a target. "dismiss" puts hidden
+// content back, "delete" deletes it. Both are recorded in the audit log.
+func ResolveReports(target_type string, target_id int32, decision string, resolved_by int32, reason string) (bool, error) {
+	table, ok := reportTables[target_type]
+	if !ok {
+		return false, ErrInvalidReport
+	}
+	status, action := "dismissed", target_type+".dismiss"
+	change, args := "UPDATE "+table+" SET status = 'posted' WHERE id = $1 AND status = 'hidden'", []any{target_id}
+	if decision == "delete" {
+		status, action = "actioned", target_type+".delete"
+		change, args = "UPDATE "+table+" SET status = 'deleted', deleted = NOW(), deleted_by = $2,"+
+			" deleted_from = CASE WHEN status = 'hidden' THEN 'posted' ELSE status END WHERE id = $1 AND status <> 'deleted'", []any{target_id, resolved_by}
+	}
+
+	audit := &models.ModAction{Actor: resolved_by, Action: action, Target_type: target_type, Target_id: target_id, Reason: reason}
+	err := audited(audit, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(context.Background(), "UPDATE reports SET status = $1, resolved_by = $2, resolved = NOW() WHERE target_type = $3 AND target_id = $4 AND status = $5",
+			status,
+			resolved_by,
+			target_type,
+			target_id,
+			"open")
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return errUnchanged
+		}
+		_, err = tx.Exec(context.Background(), change, args...)
+		return err
+	})
+	if err == errUnchanged {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// OpenReports returns reported content oldest first with the reports filed against it
+func OpenReports() ([]models.ReportedContent, error) {
+	var reported []models.ReportedContent
+	results, err := dbpool.Query(context.Background(), "SELECT r.target_type, r.target_id, COALESCE(p.poster, c.poster), COALESCE(p.id, cp.id), COALESCE(p.section, cp.section),"+
+		" COALESCE(p.title, cp.title), COALESCE(p.md, c.md), COALESCE(p.status, c.status) FROM reports r"+
+		" LEFT JOIN posts p ON r.target_type = 'post' AND p.id = r.target_id"+
+		" LEFT JOIN comments c ON r.target_type = 'comment' AND c.id = r.target_id"+
+		" LEFT JOIN posts cp ON cp.id = c.parent_post"+
+		" WHERE r.status = $1 GROUP BY r.target_type, r.target_id, p.id, c.id, cp.id ORDER BY MIN(r.id)", "open")
+	if err != nil {
+		return nil, err
+	}
+	index := map[string]int{}
+	for results.Next() {
+		var content models.ReportedContent
+		err = results.Scan(&content.Target_type,
+			&content.Target_id,
+			&content.Author,
+			&content.Pid,
+			&content.Section,
+			&content.Title,
+			&content.Md,
+			&content.Status)
+		if err != nil {
+			return nil, err
+		}
+		index[reportKey(content.Target_type, content.Target_id)] = len(reported)
+		reported = append(reported, content)
+	}
+
+	results, err = dbpool.Query(context.Background(), "SELECT r.id, u.username, r.target_type, r.target_id, r.category, r.note, r.created FROM reports r"+
+		" INNER JOIN users u ON u.id = r.reporter WHERE r.status = $1 ORDER BY r.id", "open")
+	if err != nil {
+		return nil, err
+	}
+	for results.Next() {
+		var report models.Report
+		err = results.Scan(&report.Id, &report.Reporter, &report.Target_type, &report.Target_id, &report.Category, &report.Note, &report.Created)
+		if err != nil {
+			return nil, err
+		}
+		if i, ok := index[reportKey(report.Target_type, report.Target_id)]; ok {
+			reported[i].Reports = append(reported[i].Reports, report)
+		}
+	}
+	return reported, nil
+}
+
+func reportKey(target_type string, target_id int32) string {
+	return target_type + ":" + strconv.Itoa(int(target_id))
+}
+
+// SpamReports counts spam reports filed in the last seconds
+func SpamReports(seconds int64) (int, error) {
+	var count int
+	err := dbpool.QueryRow(context.Background(), "SELECT COUNT(*) FROM reports WHERE category = $1 AND created > NOW() - $2::bigint * interval '1 second'", "spam", seconds).Scan(&count)
+	return count, err
+}
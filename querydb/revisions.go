@@ -0,0 +1,68 @@
+package querydb
+
+import (
+	"context"
+
+	"github.com/0sm1les/gopherbb/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// GetComment returns a comment with its markdown
+func GetComment(cid int32) (models.Comment, error) {
+	var comment models.Comment
+	err := dbpool.QueryRow(context.Background(), "SELECT id, poster, parent_post, parent_comment, status, md, html, time_posted, edited FROM comments WHERE id = $1", cid).Scan(
+		&comment.Cid,
+		&comment.User_id,
+		&comment.Parent_post,
+		&comment.Parent_comment,
+		&comment.Status,
+		&comment.Md,
+		&comment.Html,
+		&comment.Time_posted,
+		&comment.Edited)
+	return comment, err
+}
+
+// EditReply replaces the markdown and html of a posted comment and records the new
+// version, the first edit also records the original. Reports whether it was edited.
+func EditReply(cid int32, editor int32, md string, html string, audit *models.ModAction) (bool, error) {
+	err := audited(audit, func(tx pgx.Tx) error {
+		_, err := tx.Exec(context.Background(), "INSERT INTO comment_revisions (comment, editor, md, html, created)"+
+			" SELECT id, poster, md, html, time_posted FROM comments WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM comment_revisions WHERE comment = $1)", cid)
+		if err != nil {
+			return err
+		}
+		tag, err := tx.Exec(context.Background(), "UPDATE comments SET md = $1, html = $2, edited = NOW() WHERE id = $3 AND status = $4", md, html, cid, "posted")
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return errUnchanged
+		}
+		_, err = tx.Exec(context.Background(), "INSERT INTO comment_revisions (comment, editor, md, html, created) VALUES ($1, $2, $3, $4, NOW())", cid, editor, md, html)
+		return err
+	})
+	if err == errUnchanged {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// CommentRevisions returns every recorded version of a comment, newest first
+func CommentRevisions(cid int32) ([]models.CommentRevision, error) {
+	var revisions []models.CommentRevision
+	results, err := dbpool.Query(context.Background(), "SELECT id, comment, editor, md, html, created FROM comment_revisions WHERE comment = $1 ORDER BY id DESC", cid)
+	if err != nil {
+		return nil, err
+	}
+	for results.Next() {
+		var revision models.CommentRevision
+		err = results.Scan(&revision.Id, &revision.Comment, &revision.Editor, &revision.Md, &revision.Html, &revision.Created)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, nil
+}
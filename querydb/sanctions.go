@@ -0,0 +1,105 @@
+package querydb
+
+import (
+	"context"
+
+	"github.com/0sm1les/gopherbb/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// lockedOut is true for users with an active suspension or ban, uid names the column to check
+func lockedOut(uid string) string {
+	return "EXISTS (SELECT 1 FROM sanctions s WHERE s.uid = " + uid + " AND s.kind IN ('suspend', 'ban')" +
+		" AND s.lifted IS NULL AND (s.expires IS NULL OR s.expires > NOW()))"
+}
+
+// NewSanction records the sanction in the audit log and ends the user's sessions
+// unless it is a mute. A lifetime of 0 creates a sanction that never expires.
+func NewSanction(user_id int32, kind string, reason string, created_by int32, lifetime int64) error {
+	audit := &models.ModAction{Actor: created_by, Action: "user." + kind, Target_type: "user", Target_id: user_id, Reason: reason}
+	return audited(audit, func(tx pgx.Tx) error {
+		_, err := tx.Exec(context.Background(), "INSERT INTO sanctions (uid, kind, reason, created_by, created, expires) VALUES ($1, $2, $3, $4, NOW(),"+
+			" CASE WHEN $5::bigint > 0 THEN NOW() + $5::bigint * interval '1 second' END)",
+			user_id,
+			kind,
+			reason,
+			created_by,
+			lifetime)
+		if err != nil || kind == "mute" {
+			return err
+		}
+		_, err = tx.Exec(context.Background(), "DELETE FROM sessions WHERE uid = $1", user_id)
+		return err
+	})
+}
+
+// ActiveSanction returns the user's active sanction of one of kinds that lasts the longest, or nil
+func ActiveSanction(user_id int32, kinds []string) (*models.Sanction, error) {
+	var sanction models.Sanction
+	err := dbpool.QueryRow(context.Background(), "SELECT id, uid, kind, reason, created, expires FROM sanctions"+
+		" WHERE uid = $1 AND kind = ANY($2) AND lifted IS NULL AND (expires IS NULL OR expires > NOW())"+
+		" ORDER BY expires DESC NULLS FIRST LIMIT 1", user_id, kinds).Scan(&sanction.Id,
+		&sanction.Uid,
+		&sanction.Kind,
+		&sanction.Reason,
+		&sanction.Created,
+		&sanction.Expires)
+	if err != nil {
+		if err.Error() == "no rows in result set" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &sanction, nil
+}
+
+// UserSanctions is every sanction the user has had, newest first
+func UserSanctions(user_id int32) ([]models.Sanction, error) {
+	var sanctions []models.Sanction
+	results, err := dbpool.Query(context.Background(), "SELECT s.id, s.uid, s.kind, s.reason, u.username, s.created, s.expires, s.lifted,"+
+		" s.lifted IS NULL AND (s.expires IS NULL OR s.expires > NOW()) FROM sanctions s INNER JOIN users u ON u.id = s.created_by"+
+		" WHERE s.uid = $1 ORDER BY s.id DESC", user_id)
+	if err != nil {
+		return nil, err
+	}
+	for results.Next() {
+		var sanction models.Sanction
+		err = results.Scan(&sanction.Id,
+			&sanction.Uid,
+			&sanction.Kind,
+			&sanction.Reason,
+			&sanction.Created_by,
+			&sanction.Created,
+			&sanction.Expires,
+			&sanction.Lifted,
+			&sanction.Active)
+		if err != nil {
+			return nil, err
+		}
+		sanctions = append(sanctions, sanction)
+	}
+	return sanctions, nil
+}
+
+// only lifts the sanction if it belongs to user_id and is still in effect
+func LiftSanction(user_id int32, sanction_id int32, lifted_by int32) (bool, error) {
+	audit := &models.ModAction{Actor: lifted_by, Action: "user.lift", Target_type: "user", Target_id: user_id}
+	err := audited(audit, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(context.Background(), "UPDATE sanctions SET lifted = NOW(), lifted_by = $1 WHERE id = $2 AND uid = $3 AND lifted IS NULL",
+			lifted_by,
+			sanction_id,
+			user_id)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() != 1 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err == errUnchanged {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,91 @@
+package querydb
+
+import (
+	"context"
+
+	"github.com/0sm1les/gopherbb/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func NewSession(user_id int32, token_hash string, ip string, user_agent string) error {
+	_, err := dbpool.Exec(context.Background(), "INSERT INTO sessions (uid, token, ip, user_agent, created, last_seen) VALUES ($1, $2, $3, $4, NOW(), NOW())",
+		user_id,
+		token_hash,
+		ip,
+		user_agent)
+	return err
+}
+
+// only returns sessions that have not passed the idle or absolute timeout in seconds, 0 skips the check
+func GetSession(token_hash string, idle int64, absolute int64) (models.Session, error) {
+	var session models.Session
+	err := dbpool.QueryRow(context.Background(), "SELECT id, uid, ip, user_agent, created, last_seen FROM sessions WHERE token = $1 AND NOT "+lockedOut("sessions.uid")+
+		" AND ($2::bigint = 0 OR last_seen > NOW() - $2::bigint * interval '1 second')"+
+		" AND ($3::bigint = 0 OR created > NOW() - $3::bigint * interval '1 second')",
+		token_hash,
+		idle,
+		absolute).Scan(
+		&session.Id,
+		&session.Uid,
+		&session.Ip,
+		&session.User_agent,
+		&session.Created,
+		&session.Last_seen)
+	return session, err
+}
+
+// last_seen is only written once a minute to keep reads cheap
+func TouchSession(session_id int32, ip string, user_agent string) error {
+	_, err := dbpool.Exec(context.Background(), "UPDATE sessions SET last_seen = NOW(), ip = $1, user_agent = $2 WHERE id = $3 AND last_seen < NOW() - interval '1 minute'", ip, user_agent, session_id)
+	return err
+}
+
+func UserSessions(user_id int32) ([]models.Session, error) {
+	var sessions []models.Session
+	results, err := dbpool.Query(context.Background(), "SELECT id, uid, ip, user_agent, created, last_seen FROM sessions WHERE uid = $1 ORDER BY last_seen DESC", user_id)
+	if err != nil {
+		return nil, err
+	}
+	for results.Next() {
+		var session models.Session
+		err = results.Scan(&session.Id, &session.Uid, &session.Ip, &session.User_agent, &session.Created, &session.Last_seen)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func DeleteSession(token_hash string) error {
+	_, err := dbpool.Exec(context.Background(), "DELETE FROM sessions WHERE token = $1", token_hash)
+	return err
+}
+
+// only deletes the session if it belongs to user_id
+func RevokeSession(user_id int32, session_id int32) error {
+	_, err := dbpool.Exec(context.Background(), "DELETE FROM sessions WHERE id = $1 AND uid = $2", session_id, user_id)
+	return err
+}
+
+// revokes every session for user_id except the one with token_hash
+func RevokeOtherSessions(user_id int32, token_hash string) error {
+	_, err := dbpool.Exec(context.Background(), "DELETE FROM sessions WHERE uid = $1 AND token != $2", user_id, token_hash)
+	return err
+}
+
+func RevokeUserSessions(user_id int32, audit *models.ModAction) error {
+	return audited(audit, func(tx pgx.Tx) error {
+		_, err := tx.Exec(context.Background(), "DELETE FROM sessions WHERE uid = $1", user_id)
+		return err
+	})
+}
+
+// removes sessions idle for longer than idle seconds or older than absolute seconds, 0 skips the check
+func PurgeSessions(idle int64, absolute int64) error {
+	_, err := dbpool.Exec(context.Background(), "DELETE FROM sessions WHERE ($1::bigint > 0 AND last_seen < NOW() - $1::bigint * interval '1 second') OR ($2::bigint > 0 AND created < NOW() - $2::bigint * interval '1 second')",
+		idle,
+		absolute)
+	return err
+}
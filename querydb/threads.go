@@ -0,0 +1,42 @@
+package querydb
+
+import (
+	"context"
+
+	"github.com/0sm1les/gopherbb/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// updateThread runs stmt on a posted thread and reports whether anything changed
+func updateThread(stmt string, value any, pid int32, audit *models.ModAction) (bool, error) {
+	err := audited(audit, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(context.Background(), stmt, value, pid, "posted")
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err == errUnchanged {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SetPostLocked stops or allows new comments on a thread
+func SetPostLocked(pid int32, locked bool, audit *models.ModAction) (bool, error) {
+	return updateThread("UPDATE posts SET locked = $1 WHERE id = $2 AND status = $3 AND locked <> $1", locked, pid, audit)
+}
+
+// SetPostPinned keeps a thread at the top of its section
+func SetPostPinned(pid int32, pinned bool, audit *models.ModAction) (bool, error) {
+	return updateThread("UPDATE posts SET pinned = $1 WHERE id = $2 AND status = $3 AND pinned <> $1", pinned, pid, audit)
+}
+
+// MovePost puts a thread in another section, the caller validates the section
+func MovePost(pid int32, section string, audit *models.ModAction) (bool, error) {
+	return updateThread("UPDATE posts SET section = $1 WHERE id = $2 AND status = $3 AND section <> $1", section, pid, audit)
+}
@@ -0,0 +1,58 @@
+package querydb
+
+import (
+	"context"
+	"time"
+)
+
+func AddLoginFailure(key string, at time.Time) error {
+	_, err := dbpool.Exec(context.Background(), "INSERT INTO login_failures (key, time_failed) VALUES ($1, $2)", key, at)
+	return err
+}
+
+func CountLoginFailures(key string, since time.Time) (int, error) {
+	var count int
+	err := dbpool.QueryRow(context.Background(), "SELECT COUNT(*) FROM login_failures WHERE key = $1 AND time_failed >= $2", key, since).Scan(&count)
+	return count, err
+}
+
+func ClearLoginFailures(key string) error {
+	_, err := dbpool.Exec(context.Background(), "DELETE FROM login_failures WHERE key = $1", key)
+	return err
+}
+
+// returns a zero time and 0 strikes if key has no lock
+func GetLoginLock(key string) (time.Time, int, error) {
+	var until time.Time
+	var strikes int
+	err := dbpool.QueryRow(context.Background(), "SELECT locked_until, strikes FROM login_locks WHERE key = $1", key).Scan(&until, &strikes)
+	if err != nil {
+		if err.Error() == "no rows in result set" {
+			return time.Time{}, 0, nil
+		}
+		return time.Time{}, 0, err
+	}
+	return until, strikes, nil
+}
+
+func SetLoginLock(key string, until time.Time, strikes int) error {
+	_, err := dbpool.Exec(context.Background(), "INSERT INTO login_locks (key, locked_until, strikes) VALUES ($1, $2, $3) ON CONFLICT (key) DO UPDATE SET locked_until = $2, strikes = $3",
+		key,
+		until,
+		strikes)
+	return err
+}
+
+func ClearLoginLock(key string) error {
+	_, err := dbpool.Exec(context.Background(), "DELETE FROM login_locks WHERE key = $1", key)
+	return err
+}
+
+func PurgeLoginThrottle(before time.Time) error {
+	_, err := dbpool.Exec(context.Background(), "DELETE FROM login_failures WHERE time_failed < $1", before)
+	if err != nil {
+		return err
+	}
+	_, err = dbpool.Exec(context.Background(), "DELETE FROM login_locks WHERE locked_until < $1", before)
+	return err
+}
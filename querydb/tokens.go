@@ -0,0 +1,70 @@
+package querydb
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/0sm1les/gopherbb/models"
+)
+
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// lifetime of 0 creates a token that never expires
+func NewAPIToken(user_id int32, name string, token_hash string, scopes []string, lifetime int64) error {
+	_, err := dbpool.Exec(context.Background(), "INSERT INTO api_tokens (uid, name, token, scopes, created, expires) VALUES ($1, $2, $3, $4, NOW(),"+
+		" CASE WHEN $5::bigint > 0 THEN NOW() + $5::bigint * interval '1 second' END)",
+		user_id,
+		name,
+		token_hash,
+		strings.Join(scopes, " "),
+		lifetime)
+	return err
+}
+
+// returns the token if it is unexpired and belongs to an active user that isn't suspended or banned
+func GetAPIToken(token_hash string) (models.APIToken, error) {
+	var token models.APIToken
+	var scopes string
+	err := dbpool.QueryRow(context.Background(), "SELECT t.id, t.uid, t.name, t.scopes, t.created, t.last_used, t.expires FROM api_tokens t INNER JOIN users u ON u.id = t.uid"+
+		" WHERE t.token = $1 AND (t.expires IS NULL OR t.expires > NOW()) AND u.status = 'active' AND NOT "+lockedOut("t.uid"), token_hash).Scan(&token.Id, &token.Uid, &token.Name, &scopes, &token.Created, &token.Last_used, &token.Expires)
+	if err != nil {
+		if err.Error() == "no rows in result set" {
+			return token, ErrInvalidToken
+		}
+		return token, err
+	}
+	token.Scopes = strings.Fields(scopes)
+	return token, nil
+}
+
+// only writes when last_used is over a minute old to keep scripts from hammering the row
+func TouchAPIToken(token_id int32) error {
+	_, err := dbpool.Exec(context.Background(), "UPDATE api_tokens SET last_used = NOW() WHERE id = $1 AND (last_used IS NULL OR last_used < NOW() - interval '1 minute')", token_id)
+	return err
+}
+
+func UserAPITokens(user_id int32) ([]models.APIToken, error) {
+	var tokens []models.APIToken
+	results, err := dbpool.Query(context.Background(), "SELECT id, uid, name, scopes, created, last_used, expires FROM api_tokens WHERE uid = $1 ORDER BY id DESC", user_id)
+	if err != nil {
+		return nil, err
+	}
+	for results.Next() {
+		var token models.APIToken
+		var scopes string
+		err = results.Scan(&token.Id, &token.Uid, &token.Name, &scopes, &token.Created, &token.Last_used, &token.Expires)
+		if err != nil {
+			return nil, err
+		}
+		token.Scopes = strings.Fields(scopes)
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// only deletes the token if it belongs to user_id
+func DeleteAPIToken(user_id int32, token_id int32) error {
+	_, err := dbpool.Exec(context.Background(), "DELETE FROM api_tokens WHERE id = $1 AND uid = $2", token_id, user_id)
+	return err
+}
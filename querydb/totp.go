@@ -0,0 +1,75 @@
+package querydb
+
+import (
+	"context"
+)
+
+// returns the totp secret, whether it is enabled and the last accepted time step
+func GetTOTP(user_id int32) (string, bool, int64, error) {
+	var secret string
+	var enabled bool
+	var last_step int64
+	err := dbpool.QueryRow(context.Background(), "SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = $1", user_id).Scan(&secret, &enabled, &last_step)
+	return secret, enabled, last_step, err
+}
+
+// enables totp and replaces any existing recovery codes in one transaction
+func EnableTOTP(user_id int32, secret string, last_step int64, recovery_hashes []string) error {
+	tx, err := dbpool.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(), "UPDATE users SET totp_secret = $1, totp_enabled = true, totp_last_step = $2 WHERE id = $3", secret, last_step, user_id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(context.Background(), "DELETE FROM recovery_codes WHERE uid = $1", user_id)
+	if err != nil {
+		return err
+	}
+	for _, hash := range recovery_hashes {
+		_, err = tx.Exec(context.Background(), "INSERT INTO recovery_codes (uid, code) VALUES ($1, $2)", user_id, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(context.Background())
+}
+
+func DisableTOTP(user_id int32) error {
+	tx, err := dbpool.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(), "UPDATE users SET totp_secret = '', totp_enabled = false, totp_last_step = 0 WHERE id = $1", user_id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(context.Background(), "DELETE FROM recovery_codes WHERE uid = $1", user_id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+// records step as used, returns false if an equal or later step was already used
+func UseTOTPStep(user_id int32, step int64) (bool, error) {
+	tag, err := dbpool.Exec(context.Background(), "UPDATE users SET totp_last_step = $1 WHERE id = $2 AND totp_last_step < $1", step, user_id)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// marks a recovery code as used, returns false if it does not exist or was already used
+func UseRecoveryCode(user_id int32, code_hash string) (bool, error) {
+	tag, err := dbpool.Exec(context.Background(), "UPDATE recovery_codes SET used = true WHERE uid = $1 AND code = $2 AND used = false", user_id, code_hash)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
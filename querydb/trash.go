@@ -0,0 +1,162 @@
+package querydb
+
+import (
+	"context"
+
+	"github.com/0sm1les/gopherbb/models"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// trashQuery selects deleted posts and comments with who deleted them, $1 is "deleted"
+const trashQuery = "SELECT target_type, id, poster, pid, section, title, status, time_posted, deleted, deleted_by FROM (" +
+	"SELECT 'post' AS target_type, p.id, p.poster, p.id AS pid, p.section, p.title, p.status, p.time_posted, p.deleted, p.deleted_by AS deleted_by_uid," +
+	" COALESCE(u.username, '') AS deleted_by FROM posts p LEFT JOIN users u ON u.id = p.deleted_by WHERE p.status = $1" +
+	" UNION ALL SELECT 'comment', c.id, c.poster, p.id, p.section, p.title, c.status, c.time_posted, c.deleted, c.deleted_by, COALESCE(u.username, '')" +
+	" FROM comments c INNER JOIN posts p ON p.id = c.parent_post LEFT JOIN users u ON u.id = c.deleted_by WHERE c.status = $1" +
+	") AS trash"
+
+func scanTrash(results pgx.Rows) ([]models.ContentListing, error) {
+	var content []models.ContentListing
+	for results.Next() {
+		var listing models.ContentListing
+		err := results.Scan(&listing.Target_type,
+			&listing.Id,
+			&listing.Poster,
+			&listing.Pid,
+			&listing.Section,
+			&listing.Title,
+			&listing.Status,
+			&listing.Time_posted,
+			&listing.Deleted,
+			&listing.Deleted_by)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, listing)
+	}
+	return content, nil
+}
+
+// UserTrash returns what the user deleted of their own within window seconds, 0 for no window
+func UserTrash(user_id int32, window int64) ([]models.ContentListing, error) {
+	results, err := dbpool.Query(context.Background(), trashQuery+" WHERE poster = $2 AND deleted_by_uid = $2"+
+		" AND ($3::bigint = 0 OR deleted > NOW() - $3::bigint * interval '1 second') ORDER BY deleted DESC", "deleted", user_id, window)
+	if err != nil {
+		return nil, err
+	}
+	return scanTrash(results)
+}
+
+// DeletedContent returns the most recently deleted posts and comments
+func DeletedContent(limit int) ([]models.ContentListing, error) {
+	results, err := dbpool.Query(context.Background(), trashQuery+" ORDER BY deleted DESC NULLS LAST LIMIT $2", "deleted", limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanTrash(results)
+}
+
+// RestoreOwnPost puts back a post the user deleted themselves within window seconds, 0 for no window
+func RestoreOwnPost(pid int32, user_id int32, window int64) (bool, error) {
+	tag, err := dbpool.Exec(context.Background(), "UPDATE posts SET status = COALESCE(deleted_from, $1), deleted = NULL, deleted_by = NULL, deleted_from = NULL WHERE id = $2 AND status = $3 AND poster = $4 AND deleted_by = $4"+
+		" AND ($5::bigint = 0 OR deleted > NOW() - $5::bigint * interval '1 second')", "posted", pid, "deleted", user_id, window)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// RestoreOwnReply puts back a comment the user deleted themselves within window seconds, 0 for no window
+func RestoreOwnReply(cid int32, user_id int32, window int64) (bool, error) {
+	tag, err := dbpool.Exec(context.Background(), "UPDATE comments SET status = COALESCE(deleted_from, $1), deleted = NULL, deleted_by = NULL, deleted_from = NULL WHERE id = $2 AND status = $3 AND poster = $4 AND deleted_by = $4"+
+		" AND ($5::bigint = 0 OR deleted > NOW() - $5::bigint * interval '1 second')", "posted", cid, "deleted", user_id, window)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// PurgeDeleted gets rid of posts and comments deleted more than retention seconds ago,
+// along with the comments on purged posts and their likes, revisions and notifications. With
+// anonymize the rows are kept with their text cleared and status set to purged,
+// otherwise they are removed, except for comments that still have replies which are
+// always anonymized. Returns how many posts and comments were purged.
+func PurgeDeleted(retention int64, anonymize bool) (int64, error) {
+	tx, err := dbpool.Begin(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var posts, comments []int32
+	err = tx.QueryRow(context.Background(), "SELECT COALESCE(array_agg(id), '{}') FROM posts WHERE status = $1 AND deleted < NOW() - $2::bigint * interval '1 second'",
+		"deleted", retention).Scan(&posts)
+	if err != nil {
+		return 0, err
+	}
+	err = tx.QueryRow(context.Background(), "SELECT COALESCE(array_agg(id), '{}') FROM comments"+
+		" WHERE parent_post = ANY($1) OR (status = $2 AND deleted < NOW() - $3::bigint * interval '1 second')",
+		posts, "deleted", retention).Scan(&comments)
+	if err != nil {
+		return 0, err
+	}
+	if len(posts) == 0 && len(comments) == 0 {
+		return 0, nil
+	}
+
+	_, err = tx.Exec(context.Background(), "DELETE FROM notifications WHERE post = ANY($1) OR comment = ANY($2)", posts, comments)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(context.Background(), "DELETE FROM likes WHERE post = ANY($1)", posts)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(context.Background(), "DELETE FROM comment_likes WHERE comment = ANY($1)", comments)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(context.Background(), "DELETE FROM comment_revisions WHERE comment = ANY($1)", comments)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(context.Background(), "UPDATE reports SET status = $1, resolved = NOW() WHERE status = $2"+
+		" AND ((target_type = 'post' AND target_id = ANY($3)) OR (target_type = 'comment' AND target_id = ANY($4)))", "actioned", "open", posts, comments)
+	if err != nil {
+		return 0, err
+	}
+	if anonymize {
+		_, err = tx.Exec(context.Background(), "UPDATE comments SET status = $1, md = '', html = '' WHERE id = ANY($2)", "purged", comments)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(context.Background(), "UPDATE posts SET status = $1, title = '[deleted]', md = '', html = '', locked = false, pinned = false WHERE id = ANY($2)", "purged", posts)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		// comments with replies that stay are anonymized instead so the replies keep their place in the thread
+		var parents []int32
+		err = tx.QueryRow(context.Background(), "WITH RECURSIVE kept AS ("+
+			"SELECT parent_comment AS id FROM comments WHERE parent_comment = ANY($1) AND NOT (id = ANY($1))"+
+			" UNION SELECT c.parent_comment FROM comments c INNER JOIN kept ON c.id = kept.id WHERE c.parent_comment = ANY($1)"+
+			") SELECT COALESCE(array_agg(id), '{}') FROM kept", comments).Scan(&parents)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(context.Background(), "UPDATE comments SET status = $1, md = '', html = '' WHERE id = ANY($2)", "purged", parents)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(context.Background(), "DELETE FROM comments WHERE id = ANY($1) AND NOT (id = ANY($2))", comments, parents)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(context.Background(), "DELETE FROM posts WHERE id = ANY($1)", posts)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(posts) + len(comments)), tx.Commit(context.Background())
+}
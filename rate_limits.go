@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/0sm1les/gopherbb/models"
+	"github.com/0sm1les/gopherbb/querydb"
+	"github.com/0sm1les/gopherbb/throttle"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	actionPost  = "post"
+	actionReply = "reply"
+	actionLike  = "like"
+)
+
+var rateActions = []string{actionPost, actionReply, actionLike}
+
+// defaultRateLimits is used for every role and action config.Rate_limits.Roles leaves out,
+// mods and admins aren't limited
+var defaultRateLimits = map[string]map[string]models.RateLimit{
+	"unranked": {
+		actionPost:  {Burst: 2, Every: "10m"},
+		actionReply: {Burst: 5, Every: "2m"},
+		actionLike:  {Burst: 20, Every: "30s"},
+	},
+	"ranked": {
+		actionPost:  {Burst: 5, Every: "5m"},
+		actionReply: {Burst: 10, Every: "30s"},
+		actionLike:  {Burst: 30, Every: "10s"},
+	},
+	"mod":   {},
+	"admin": {},
+}
+
+var defaultIpLimits = map[string]models.RateLimit{
+	actionPost:  {Burst: 10, Every: "2m"},
+	actionReply: {Burst: 30, Every: "20s"},
+	actionLike:  {Burst: 60, Every: "5s"},
+}
+
+type rateLimit struct {
+	burst int
+	every time.Duration
+}
+
+var (
+	// role to action to limit, actions without a limit are left out
+	userLimits = map[string]map[string]rateLimit{}
+	ipLimits   = map[string]rateLimit{}
+	buckets    = throttle.NewBuckets()
+)
+
+func validAction(action string) bool {
+	for _, a := range rateActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// compileLimits merges conf over defaults and drops the actions that aren't limited
+func compileLimits(defaults map[string]models.RateLimit, conf map[string]models.RateLimit) (map[string]rateLimit, error) {
+	merged := map[string]models.RateLimit{}
+	for action, limit := range defaults {
+		merged[action] = limit
+	}
+	for action, limit := range conf {
+		if !validAction(action) {
+			return nil, fmt.Errorf("unknown action %q", action)
+		}
+		merged[action] = limit
+	}
+	compiled := map[string]rateLimit{}
+	for action, limit := range merged {
+		if limit.Burst <= 0 {
+			continue
+		}
+		every, err := time.ParseDuration(limit.Every)
+		if err != nil {
+			return nil, fmt.Errorf("rate limit for %q: %w", action, err)
+		}
+		if every <= 0 {
+			return nil, fmt.Errorf("rate limit for %q must earn requests back over time", action)
+		}
+		compiled[action] = rateLimit{burst: limit.Burst, every: every}
+	}
+	return compiled, nil
+}
+
+func setupRateLimits(conf models.RateLimitConfig) error {
+	for role := range conf.Roles {
+		if _, ok := defaultRateLimits[role]; !ok {
+			return fmt.Errorf("unknown role %q", role)
+		}
+	}
+	for role, defaults := range defaultRateLimits {
+		compiled, err := compileLimits(defaults, conf.Roles[role])
+		if err != nil {
+			return err
+		}
+		userLimits[role] = compiled
+	}
+	compiled, err := compileLimits(defaultIpLimits, conf.Ip)
+	if err != nil {
+		return err
+	}
+	ipLimits = compiled
+	return nil
+}
+
+func purgeBuckets() {
+	for range time.Tick(time.Hour) {
+		buckets.Purge()
+	}
+}
+
+// rateLimited refuses the request once the user or their ip address has used up
+// its requests for action. It runs after apiTokenAuth so token clients count too.
+func rateLimited(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, _ := store.Get(c.Request, "session")
+		uid, _ := session.Values["id"].(int32)
+		if uid <= 0 {
+			c.Next()
+			return
+		}
+		userinfo, err := querydb.Userinfo(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			c.AbortWithStatus(500)
+			return
+		}
+		if limit, ok := ipLimits[action]; ok {
+			if wait, ok := buckets.Take(action+":"+ipKey(c), limit.burst, limit.every); !ok {
+				refuseRateLimited(c, wait)
+				return
+			}
+		}
+		if limit, ok := userLimits[userinfo.Role][action]; ok {
+			if wait, ok := buckets.Take(action+":uid:"+strconv.Itoa(int(uid)), limit.burst, limit.every); !ok {
+				logger.Warn().Str("action", action).Str("username", string(userinfo.Username)).Msg("rate limited")
+				refuseRateLimited(c, wait)
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// refuseRateLimited answers htmx with a feedback fragment since it only swaps
+// successful responses, everything else gets a 429
+func refuseRateLimited(c *gin.Context, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	message := "you're doing that too often, try again in " + (time.Duration(seconds) * time.Second).String()
+	if c.GetHeader("HX-Request") != "" {
+		html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": message})
+		c.Abort()
+		return
+	}
+	c.AbortWithStatusJSON(429, gin.H{"error": message})
+}
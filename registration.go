@@ -0,0 +1,120 @@
+package main
+
+import (
+	"html/template"
+	"strconv"
+	"time"
+
+	"github.com/0sm1les/gopherbb/auth"
+	"github.com/0sm1les/gopherbb/models"
+	"github.com/0sm1les/gopherbb/querydb"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxInviteUses     = 25
+	maxInviteLifetime = 30 * 24 * time.Hour
+)
+
+func newInvite(uid int32, c *gin.Context) {
+	userinfo, err := querydb.Userinfo(uid)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	if !can(userinfo.Role, capInviteCreate) {
+		logger.Error().Msg("user tried to access unauthorized resource")
+		return
+	}
+
+	uses, err := strconv.ParseInt(c.PostForm("uses"), 10, 32)
+	if err != nil || uses < 1 || (uses > maxInviteUses && !can(userinfo.Role, capInviteUnlimited)) {
+		html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "invalid number of uses"})
+		return
+	}
+
+	days, err := strconv.ParseInt(c.PostForm("days"), 10, 32)
+	lifetime := time.Duration(days) * 24 * time.Hour
+	if err != nil || days < 1 || lifetime > maxInviteLifetime {
+		html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "invalid expiry"})
+		return
+	}
+
+	code, err := auth.NewToken()
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	// a shorter code is easier to share and still has 128 bits of entropy
+	code = code[:32]
+
+	if err := querydb.NewInvite(uid, auth.HashToken(code), int32(uses), int64(lifetime.Seconds())); err != nil {
+		logger.Error().Err(err).Msg("")
+		html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "error creating invite"})
+		return
+	}
+
+	html := template.Must(newTemplate().ParseFiles("html/htmx/invite.html"))
+	html.ExecuteTemplate(c.Writer, "html/htmx/invite.html", gin.H{"Code": code})
+}
+
+// approvals is the queue mods use to approve accounts when registration is set to approval
+func approvals(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		userinfo, err := querydb.Userinfo(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if c.Request.Method == "GET" {
+			pending, err := querydb.PendingUsers()
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+			for i := 0; i < len(pending); i++ {
+				pending[i].Date_formatted = formattedTime(pending[i].Date_Joined)
+			}
+
+			html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/approvals.html", "html/footer.html"))
+			html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "approvals", "Userinfo": userinfo, "Csrf": csrfToken(c)})
+			html.ExecuteTemplate(c.Writer, "html/approvals.html", gin.H{"Pending": pending})
+			html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
+		} else if c.Request.Method == "POST" {
+			pending_uid, err := strconv.ParseInt(c.Param("uid"), 10, 32)
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+
+			status := ""
+			if c.Param("decision") == "approve" {
+				status = "active"
+			} else if c.Param("decision") == "reject" {
+				status = "rejected"
+			} else {
+				return
+			}
+
+			changed, err := querydb.SetPendingUserStatus(int32(pending_uid), status,
+				&models.ModAction{Actor: uid, Action: "user." + c.Param("decision"), Target_type: "user", Target_id: int32(pending_uid)})
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+			if changed && status == "active" {
+				err = querydb.NewNotification(int32(pending_uid), uid, "Approved your account, welcome!")
+				if err != nil {
+					logger.Error().Err(err).Msg("")
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"html/template"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/0sm1les/gopherbb/querydb"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reportCategories are the reasons a report can give, in the order the form lists them
+var reportCategories = []struct {
+	Name        string
+	Description string
+}{
+	{"spam", "spam"},
+	{"abuse", "abuse or harassment"},
+	{"off_topic", "off topic"},
+	{"other", "something else"},
+}
+
+func validReportCategory(category string) bool {
+	for _, c := range reportCategories {
+		if c.Name == category {
+			return true
+		}
+	}
+	return false
+}
+
+// reportContent shows the report form for a post or comment and files the report
+func reportContent(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		feedback := func(result string, message string) {
+			html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+			html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": result, "Message": message})
+		}
+
+		target := c.Param("target")
+		target_id, err := strconv.ParseInt(c.Param("id"), 10, 32)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		author, section, err := querydb.ReportTarget(target, int32(target_id))
+		if err == querydb.ErrInvalidReport {
+			feedback("error", err.Error())
+			return
+		} else if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if !canReadPost(section, viewer(uid)) {
+			c.AbortWithStatus(404)
+			return
+		}
+		if author == uid {
+			feedback("error", "you can't report your own "+target)
+			return
+		}
+
+		if c.Request.Method == "GET" {
+			html := template.Must(newTemplate().ParseFiles("html/htmx/report.html"))
+			html.ExecuteTemplate(c.Writer, "html/htmx/report.html", gin.H{"Target": target, "Id": target_id, "Categories": reportCategories})
+			return
+		}
+
+		category := c.PostForm("category")
+		if !validReportCategory(category) {
+			feedback("error", "pick a category")
+			return
+		}
+		note := strings.TrimSpace(c.PostForm("note"))
+		if utf8.RuneCountInString(note) > 500 {
+			feedback("error", "the note can be at most 500 characters")
+			return
+		}
+
+		filed, err := querydb.NewReport(uid, target, int32(target_id), category, note, config.Reports.Hide_after)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			feedback("error", "error filing report")
+			return
+		}
+		if !filed {
+			feedback("error", "you already reported this "+target)
+			return
+		}
+		feedback("ok", "reported, thanks")
+	}
+}
+
+// reportQueue is where mods work through reported posts and comments
+func reportQueue(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		userinfo, err := querydb.Userinfo(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if c.Request.Method == "GET" {
+			reported, err := querydb.OpenReports()
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+			for i := 0; i < len(reported); i++ {
+				reported[i].Author_listing, err = querydb.GetUser(reported[i].Author)
+				if err != nil {
+					logger.Error().Err(err).Msg("")
+					return
+				}
+			}
+
+			html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/reports.html", "html/footer.html"))
+			html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "reports", "Userinfo": userinfo, "Csrf": csrfToken(c)})
+			html.ExecuteTemplate(c.Writer, "html/reports.html", gin.H{"Reported": reported, "Can_sanction": can(userinfo.Role, capUserBan)})
+			html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
+		} else if c.Request.Method == "POST" {
+			target_id, err := strconv.ParseInt(c.Param("id"), 10, 32)
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+			decision := c.Param("decision")
+			if decision != "dismiss" && decision != "delete" {
+				return
+			}
+			if _, err := querydb.ResolveReports(c.Param("target"), int32(target_id), decision, uid, modReason(c)); err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+		}
+	}
+}
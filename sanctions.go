@@ -0,0 +1,134 @@
+package main
+
+import (
+	"html/template"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/0sm1les/gopherbb/auth"
+	"github.com/0sm1les/gopherbb/models"
+	"github.com/0sm1les/gopherbb/querydb"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sanctionKinds maps a kind to how it reads in messages. Mutes make an
+// account read only, suspensions and bans also stop it from logging in.
+var sanctionKinds = map[string]string{
+	"mute":    "muted",
+	"suspend": "suspended",
+	"ban":     "banned",
+}
+
+func sanctionMessage(sanction *models.Sanction) string {
+	message := "Your account is " + sanctionKinds[sanction.Kind]
+	if sanction.Expires != nil {
+		message += " until " + sanction.Expires.Format("2006-01-02 15:04")
+	}
+	return message + ": " + sanction.Reason
+}
+
+// lockoutMessage returns why uid can't log in, or "" when they can
+func lockoutMessage(uid int32) (string, error) {
+	sanction, err := querydb.ActiveSanction(uid, []string{"suspend", "ban"})
+	if err != nil || sanction == nil {
+		return "", err
+	}
+	return sanctionMessage(sanction), nil
+}
+
+// writeRestriction returns why uid can't post, comment or like, or "" when they can
+func writeRestriction(uid int32) (string, error) {
+	sanction, err := querydb.ActiveSanction(uid, []string{"mute", "suspend", "ban"})
+	if err != nil || sanction == nil {
+		return "", err
+	}
+	return sanctionMessage(sanction), nil
+}
+
+func sanctionUser(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		feedback := func(message string) {
+			html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+			html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": message})
+		}
+
+		user, err := auth.ValidateUser(c.Param("user"))
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		other_uid := querydb.UserExists(user)
+		if other_uid == -1 {
+			return
+		}
+		other_userinfo, err := querydb.Userinfo(other_uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if other_uid == uid || can(other_userinfo.Role, capUserBan) {
+			feedback("users that can sanction others can't be sanctioned")
+			return
+		}
+
+		kind := c.PostForm("kind")
+		if _, ok := sanctionKinds[kind]; !ok {
+			feedback("invalid sanction")
+			return
+		}
+		reason := strings.TrimSpace(c.PostForm("reason"))
+		if reason == "" || utf8.RuneCountInString(reason) > 255 {
+			feedback("reason must be between 1 and 255 characters")
+			return
+		}
+		var lifetime time.Duration
+		if c.PostForm("duration") != "" {
+			lifetime, err = time.ParseDuration(c.PostForm("duration"))
+			if err != nil || lifetime <= 0 {
+				feedback("invalid duration")
+				return
+			}
+		}
+
+		if err := querydb.NewSanction(other_uid, kind, reason, uid, int64(lifetime.Seconds())); err != nil {
+			logger.Error().Err(err).Msg("")
+			feedback("error saving sanction")
+			return
+		}
+		logger.Info().Str("kind", kind).Str("username", string(user)).Int32("by", uid).Msg("sanctioned user")
+		c.Header("HX-Refresh", "true")
+	}
+}
+
+func liftSanction(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		user, err := auth.ValidateUser(c.Param("user"))
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		other_uid := querydb.UserExists(user)
+		if other_uid == -1 {
+			return
+		}
+		sanction_id, err := strconv.ParseInt(c.Param("id"), 10, 32)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if _, err := querydb.LiftSanction(other_uid, int32(sanction_id), uid); err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		c.Header("HX-Refresh", "true")
+	}
+}
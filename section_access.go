@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/0sm1les/gopherbb/models"
+	"github.com/0sm1les/gopherbb/querydb"
+)
+
+// validateSectionAccess checks that every role and group a section names exists
+func validateSectionAccess() error {
+	for _, section := range Sections {
+		for _, list := range [][]string{section.Read, section.Post, section.Reply} {
+			for _, entry := range list {
+				if group, ok := strings.CutPrefix(entry, "group:"); ok {
+					if _, ok := config.Groups[group]; !ok {
+						return fmt.Errorf("section %s uses unknown group %q", section.Id, group)
+					}
+				} else if _, ok := defaultRoles[entry]; !ok {
+					return fmt.Errorf("section %s uses unknown role %q", section.Id, entry)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// viewer returns the logged in user or nil for anonymous requests
+func viewer(uid int32) *models.User {
+	if uid == -1 {
+		return nil
+	}
+	userinfo, err := querydb.Userinfo(uid)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return nil
+	}
+	return &userinfo
+}
+
+func inGroup(group string, username models.Username) bool {
+	for _, member := range config.Groups[group] {
+		if member == string(username) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedBy reports whether userinfo matches an entry in list, an empty list allows everyone
+func allowedBy(list []string, userinfo *models.User) bool {
+	if len(list) == 0 {
+		return true
+	}
+	if userinfo == nil {
+		return false
+	}
+	for _, entry := range list {
+		if group, ok := strings.CutPrefix(entry, "group:"); ok {
+			if inGroup(group, userinfo.Username) {
+				return true
+			}
+		} else if entry == userinfo.Role {
+			return true
+		}
+	}
+	return false
+}
+
+func canRead(section models.Section, userinfo *models.User) bool {
+	return allowedBy(section.Read, userinfo)
+}
+
+func canPostIn(section models.Section, userinfo *models.User) bool {
+	return canRead(section, userinfo) && allowedBy(section.Post, userinfo)
+}
+
+func canReplyIn(section models.Section, userinfo *models.User) bool {
+	return canRead(section, userinfo) && allowedBy(section.Reply, userinfo)
+}
+
+// canReadPost checks the section a post is in. Posts in sections that were
+// removed from the config are treated as hidden.
+func canReadPost(section_id string, userinfo *models.User) bool {
+	section, ok := Sections[section_id]
+	return ok && canRead(section, userinfo)
+}
+
+// visibleSections lists the section ids userinfo can read for filtering queries,
+// posts left in sections that were removed from the config aren't in it
+func visibleSections(userinfo *models.User) []string {
+	visible := []string{}
+	for id, section := range Sections {
+		if canRead(section, userinfo) {
+			visible = append(visible, id)
+		}
+	}
+	return visible
+}
+
+// visibleCategories is config.Categories without the sections allowed doesn't accept
+func visibleCategories(userinfo *models.User, allowed func(models.Section, *models.User) bool) []models.Category {
+	var categories []models.Category
+	for _, category := range config.Categories {
+		var sections []models.Section
+		for _, section := range category.Sections {
+			if allowed(section, userinfo) {
+				sections = append(sections, section)
+			}
+		}
+		if len(sections) > 0 {
+			categories = append(categories, models.Category{Category: category.Category, Sections: sections})
+		}
+	}
+	return categories
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0sm1les/gopherbb/auth"
+	"github.com/0sm1les/gopherbb/models"
+	"github.com/0sm1les/gopherbb/querydb"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// dbStore keeps the signed cookie from sessions.CookieStore but only trusts
+// Values["id"] while the token in Values["sid"] has a row in the sessions table.
+// Anonymous sessions never touch the database.
+type dbStore struct {
+	*sessions.CookieStore
+	idle     time.Duration
+	absolute time.Duration
+}
+
+func newDBStore(keyPairs ...[]byte) *dbStore {
+	store := &dbStore{CookieStore: sessions.NewCookieStore(keyPairs...)}
+	store.Options.HttpOnly = true
+	store.Options.SameSite = http.SameSiteLaxMode
+	return store
+}
+
+// SetTimeouts sets the idle and absolute session lifetime, 0 disables a timeout
+func (s *dbStore) SetTimeouts(idle time.Duration, absolute time.Duration) {
+	s.idle = idle
+	s.absolute = absolute
+	if absolute > 0 {
+		s.MaxAge(int(absolute.Seconds()))
+	}
+}
+
+func (s *dbStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *dbStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, cookie.Value, &session.Values, s.Codecs...); err != nil {
+		return session, err
+	}
+	session.IsNew = false
+
+	sid, ok := session.Values["sid"].(string)
+	if !ok {
+		// cookies from before the session table only carried the id
+		session.Values["id"] = int32(-1)
+		return session, nil
+	}
+
+	row, err := querydb.GetSession(auth.HashToken(sid), int64(s.idle.Seconds()), int64(s.absolute.Seconds()))
+	if err != nil {
+		delete(session.Values, "sid")
+		session.Values["id"] = int32(-1)
+		return session, nil
+	}
+	session.Values["id"] = row.Uid
+
+	if err := querydb.TouchSession(row.Id, clientIP(r), userAgent(r)); err != nil {
+		logger.Error().Err(err).Msg("")
+	}
+	return session, nil
+}
+
+func (s *dbStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	// requests authenticated by an api token don't get a cookie
+	if _, ok := session.Values["api_token"]; ok {
+		return nil
+	}
+
+	uid, _ := session.Values["id"].(int32)
+	sid, hasSid := session.Values["sid"].(string)
+
+	if hasSid && (uid == -1 || session.Options.MaxAge < 0) {
+		if err := querydb.DeleteSession(auth.HashToken(sid)); err != nil {
+			return err
+		}
+		delete(session.Values, "sid")
+		hasSid = false
+	}
+
+	if !hasSid && uid > 0 && session.Options.MaxAge >= 0 {
+		token, err := auth.NewToken()
+		if err != nil {
+			return err
+		}
+		if err := querydb.NewSession(uid, auth.HashToken(token), clientIP(r), userAgent(r)); err != nil {
+			return err
+		}
+		session.Values["sid"] = token
+	}
+
+	return s.CookieStore.Save(r, w, session)
+}
+
+// rotate drops the current server side session so the next Save issues a new token
+func (s *dbStore) rotate(session *sessions.Session) error {
+	if sid, ok := session.Values["sid"].(string); ok {
+		delete(session.Values, "sid")
+		return querydb.DeleteSession(auth.HashToken(sid))
+	}
+	return nil
+}
+
+// parseTimeouts reads the session timeouts from config
+func parseTimeouts(conf models.SessionConfig) (time.Duration, time.Duration, error) {
+	var idle, absolute time.Duration
+	var err error
+	if conf.Idle_timeout != "" {
+		if idle, err = time.ParseDuration(conf.Idle_timeout); err != nil {
+			return 0, 0, err
+		}
+	}
+	if conf.Absolute_timeout != "" {
+		if absolute, err = time.ParseDuration(conf.Absolute_timeout); err != nil {
+			return 0, 0, err
+		}
+	}
+	return idle, absolute, nil
+}
+
+// purgeSessions periodically removes expired sessions from the database
+func purgeSessions() {
+	for range time.Tick(time.Hour) {
+		if err := querydb.PurgeSessions(int64(store.idle.Seconds()), int64(store.absolute.Seconds())); err != nil {
+			logger.Error().Err(err).Msg("")
+		}
+	}
+}
+
+// trustedProxies are the networks from config.Trusted_proxies
+var trustedProxies []*net.IPNet
+
+func setupTrustedProxies(proxies []string) error {
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return err
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	return nil
+}
+
+func trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address the request came from. Forwarding headers are only
+// believed when the connection comes from a trusted proxy, and X-Forwarded-For is
+// read from the right so a client can't put its own address in front.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !trustedProxy(ip) {
+		return ip
+	}
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			ip = hop
+			if !trustedProxy(hop) {
+				return hop
+			}
+		}
+		return ip
+	}
+	if real := strings.TrimSpace(r.Header.Get("X-Real-Ip")); net.ParseIP(real) != nil {
+		return real
+	}
+	return ip
+}
+
+func userAgent(r *http.Request) string {
+	ua := r.UserAgent()
+	if len(ua) > 255 {
+		ua = ua[:255]
+	}
+	return ua
+}
+
+func userSessions(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		userinfo, err := querydb.Userinfo(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+
+		userSessions, err := querydb.UserSessions(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+
+		if sid, ok := session.Values["sid"].(string); ok {
+			current, err := querydb.GetSession(auth.HashToken(sid), 0, 0)
+			if err == nil {
+				for i := 0; i < len(userSessions); i++ {
+					userSessions[i].Current = userSessions[i].Id == current.Id
+				}
+			}
+		}
+
+		html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/sessions.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "sessions", "Userinfo": userinfo, "Csrf": csrfToken(c)})
+		html.ExecuteTemplate(c.Writer, "html/sessions.html", gin.H{"Sessions": userSessions})
+		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
+	}
+}
+
+func revokeSession(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		sid, err := strconv.ParseInt(c.Param("sid"), 10, 32)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+
+		if err := querydb.RevokeSession(uid, int32(sid)); err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+	}
+}
+
+// revokeUserSessions lets an admin log a user out everywhere
+func revokeUserSessions(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		user, err := auth.ValidateUser(c.Param("user"))
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+
+		other_uid := querydb.UserExists(user)
+		if other_uid == -1 {
+			return
+		}
+
+		if err := querydb.RevokeUserSessions(other_uid, &models.ModAction{Actor: uid, Action: "user.sessions", Target_type: "user", Target_id: other_uid}); err != nil {
+			logger.Error().Err(err).Msg("")
+			html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+			html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "error ending sessions"})
+			return
+		}
+		html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "ok", "Message": "ended all sessions"})
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"math/bits"
+	"os"
+	"time"
+
+	"github.com/0sm1les/gopherbb/models"
+	"github.com/0sm1les/gopherbb/pow"
+	"github.com/0sm1les/gopherbb/querydb"
+	"github.com/0sm1les/gopherbb/throttle"
+)
+
+var (
+	challenges        *pow.Challenges
+	challengeLifetime time.Duration
+	spamWindow        time.Duration
+	minDifficulty     int
+	maxDifficulty     int
+	// failed honeypot and proof of work checks, they raise the difficulty for everyone
+	spamFailures = throttle.NewMemory()
+)
+
+// spamChallenge is what html/spam.html needs to render a challenge
+type spamChallenge struct {
+	Challenge  string
+	Difficulty int
+}
+
+// spamAnswer is what a form sends back, Website is the honeypot and must stay empty
+type spamAnswer struct {
+	Challenge string `json:"pow_challenge" form:"pow_challenge"`
+	Nonce     string `json:"pow_nonce" form:"pow_nonce"`
+	Website   string `json:"website" form:"website"`
+}
+
+// setupSpam reads config.Spam, unset values get a sane default. Used challenges
+// are kept in the same backend as the login throttle.
+func setupSpam(conf models.SpamConfig, backend string) error {
+	var err error
+	if challengeLifetime, err = durationOr(conf.Challenge_lifetime, 10*time.Minute); err != nil {
+		return err
+	}
+	if spamWindow, err = durationOr(conf.Window, time.Hour); err != nil {
+		return err
+	}
+	minDifficulty = conf.Min_difficulty
+	if minDifficulty == 0 {
+		minDifficulty = 16
+	}
+	maxDifficulty = conf.Max_difficulty
+	if maxDifficulty == 0 {
+		maxDifficulty = minDifficulty + 6
+	}
+	if minDifficulty < 0 || maxDifficulty < minDifficulty || maxDifficulty > 32 {
+		return errors.New("difficulty must be between 0 and 32 bits with Min_difficulty <= Max_difficulty")
+	}
+	// challenges verify on every instance sharing the cookie key, only the postgres
+	// backend also stops a used one from being replayed after a restart or elsewhere
+	var used pow.Used
+	switch backend {
+	case "", "memory":
+		used = pow.NewMemory()
+	case "postgres":
+		used = pow.NewPostgres()
+	default:
+		return errors.New("throttle backend must be memory or postgres")
+	}
+	key := sha256.Sum256([]byte("pow:" + os.Getenv("gopherbb_cookie_key")))
+	challenges = pow.New(key[:], used)
+	return nil
+}
+
+func purgeChallenges() {
+	for range time.Tick(time.Hour) {
+		if err := challenges.Purge(); err != nil {
+			logger.Error().Err(err).Msg("")
+		}
+	}
+}
+
+// spamDifficulty grows by a bit each time recent failures and spam reports double
+func spamDifficulty() (int, error) {
+	failures, err := spamFailures.CountFailures("spam", time.Now().Add(-spamWindow))
+	if err != nil {
+		return 0, err
+	}
+	reports, err := querydb.SpamReports(int64(spamWindow.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+	difficulty := minDifficulty + bits.Len(uint(failures+reports))
+	if difficulty > maxDifficulty {
+		return maxDifficulty, nil
+	}
+	return difficulty, nil
+}
+
+// newChallenge issues a challenge for purpose at the current difficulty
+func newChallenge(purpose string) *spamChallenge {
+	difficulty, err := spamDifficulty()
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		difficulty = maxDifficulty
+	}
+	return &spamChallenge{Challenge: challenges.Issue(purpose, difficulty, challengeLifetime), Difficulty: difficulty}
+}
+
+// registrationChallenge is nil when registrations aren't checked
+func registrationChallenge() *spamChallenge {
+	if !config.Spam.Registration {
+		return nil
+	}
+	return newChallenge("register")
+}
+
+// checkSpam returns why answer failed the checks for purpose, or "" when it passed
+func checkSpam(purpose string, answer spamAnswer) string {
+	if answer.Website != "" {
+		spamFailures.AddFailure("spam", time.Now())
+		logger.Warn().Str("purpose", purpose).Msg("honeypot filled in")
+		return "your request looks automated, please try again"
+	}
+	if err := challenges.Verify(purpose, answer.Challenge, answer.Nonce); err != nil {
+		if !pow.Failed(err) {
+			logger.Error().Err(err).Msg("")
+			return "the anti-spam check could not be verified, please try again"
+		}
+		spamFailures.AddFailure("spam", time.Now())
+		logger.Warn().Err(err).Str("purpose", purpose).Msg("proof of work failed")
+		if err == pow.ErrExpired {
+			return "the anti-spam check expired, reload the page and try again"
+		}
+		return "the anti-spam check failed, reload the page and try again"
+	}
+	return ""
+}
+
+// postChallenged reports whether userinfo's next post needs to pass the spam checks
+func postChallenged(userinfo models.User) (bool, error) {
+	if config.Spam.First_posts <= 0 {
+		return false, nil
+	}
+	count, err := querydb.PostedCount(userinfo.Id)
+	if err != nil {
+		return false, err
+	}
+	return count < config.Spam.First_posts, nil
+}
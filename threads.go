@@ -0,0 +1,94 @@
+package main
+
+import (
+	"html/template"
+	"strconv"
+
+	"github.com/0sm1les/gopherbb/models"
+	"github.com/0sm1les/gopherbb/querydb"
+
+	"github.com/gin-gonic/gin"
+)
+
+// threadPost is the posted thread a mod is acting on, ok is false when there is none
+func threadPost(c *gin.Context) (models.Post, bool) {
+	pid, err := strconv.ParseInt(c.Param("pid"), 10, 32)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return models.Post{}, false
+	}
+	post, err := querydb.GetPost(int32(pid))
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return models.Post{}, false
+	}
+	return post, post.Status == "posted"
+}
+
+// lockThread locks a thread on POST and unlocks it on DELETE
+func lockThread(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		post, ok := threadPost(c)
+		if !ok {
+			return
+		}
+		locked, action := c.Request.Method == "POST", "post.lock"
+		if !locked {
+			action = "post.unlock"
+		}
+		if _, err := querydb.SetPostLocked(post.Pid, locked, &models.ModAction{Actor: uid, Action: action, Target_type: "post", Target_id: post.Pid, Reason: modReason(c)}); err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		c.Header("HX-Refresh", "true")
+	}
+}
+
+// pinThread pins a thread on POST and unpins it on DELETE
+func pinThread(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		post, ok := threadPost(c)
+		if !ok {
+			return
+		}
+		pinned, action := c.Request.Method == "POST", "post.pin"
+		if !pinned {
+			action = "post.unpin"
+		}
+		if _, err := querydb.SetPostPinned(post.Pid, pinned, &models.ModAction{Actor: uid, Action: action, Target_type: "post", Target_id: post.Pid, Reason: modReason(c)}); err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		c.Header("HX-Refresh", "true")
+	}
+}
+
+// moveThread moves a thread to another section, old links redirect through viewPost
+func moveThread(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		post, ok := threadPost(c)
+		if !ok {
+			return
+		}
+		section, err := validateSection(c.PostForm("section"))
+		if err != nil {
+			html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+			html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": err.Error()})
+			return
+		}
+		if _, err := querydb.MovePost(post.Pid, section.Id, &models.ModAction{Actor: uid, Action: "post.move", Target_type: "post", Target_id: post.Pid, Reason: modReason(c)}); err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		c.Header("HX-Refresh", "true")
+	}
+}
@@ -0,0 +1,65 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// when the bucket will be full again and can be forgotten
+	full time.Time
+}
+
+// Buckets rate limits keys with a token bucket each, kept in memory
+type Buckets struct {
+	mu      sync.Mutex
+	buckets map[string]bucket
+}
+
+func NewBuckets() *Buckets {
+	return &Buckets{buckets: make(map[string]bucket)}
+}
+
+// Take spends a token from key's bucket, which holds burst tokens and earns one
+// back every interval. When the bucket is empty it returns false and how long
+// until the next token.
+func (b *Buckets) Take(key string, burst int, every time.Duration) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	bk, ok := b.buckets[key]
+	if !ok {
+		bk = bucket{tokens: float64(burst)}
+	} else {
+		bk.tokens += float64(now.Sub(bk.updated)) / float64(every)
+		if bk.tokens > float64(burst) {
+			bk.tokens = float64(burst)
+		}
+	}
+	bk.updated = now
+
+	var wait time.Duration
+	taken := bk.tokens >= 1
+	if taken {
+		bk.tokens--
+	} else {
+		wait = time.Duration((1 - bk.tokens) * float64(every))
+	}
+	bk.full = now.Add(time.Duration((float64(burst) - bk.tokens) * float64(every)))
+	b.buckets[key] = bk
+	return wait, taken
+}
+
+// Purge forgets buckets that have filled up again, they start out full anyway
+func (b *Buckets) Purge() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for key, bk := range b.buckets {
+		if bk.full.Before(now) {
+			delete(b.buckets, key)
+		}
+	}
+}
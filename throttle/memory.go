@@ -0,0 +1,85 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+type lock struct {
+	until   time.Time
+	strikes int
+}
+
+type Memory struct {
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	locks    map[string]lock
+}
+
+func NewMemory() *Memory {
+	return &Memory{failures: make(map[string][]time.Time), locks: make(map[string]lock)}
+}
+
+func (m *Memory) AddFailure(key string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures[key] = append(m.failures[key], at)
+	return nil
+}
+
+func (m *Memory) CountFailures(key string, since time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// failures are appended in order so everything before the window can be dropped
+	times := m.failures[key]
+	i := 0
+	for i < len(times) && times[i].Before(since) {
+		i++
+	}
+	m.failures[key] = times[i:]
+	return len(times) - i, nil
+}
+
+func (m *Memory) ClearFailures(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.failures, key)
+	return nil
+}
+
+func (m *Memory) GetLock(key string) (time.Time, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := m.locks[key]
+	return l.until, l.strikes, nil
+}
+
+func (m *Memory) SetLock(key string, until time.Time, strikes int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.locks[key] = lock{until: until, strikes: strikes}
+	return nil
+}
+
+func (m *Memory) ClearLock(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.locks, key)
+	return nil
+}
+
+func (m *Memory) Purge(before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, times := range m.failures {
+		if len(times) == 0 || times[len(times)-1].Before(before) {
+			delete(m.failures, key)
+		}
+	}
+	for key, l := range m.locks {
+		if l.until.Before(before) {
+			delete(m.locks, key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package throttle
+
+import (
+	"time"
+
+	"github.com/0sm1les/gopherbb/querydb"
+)
+
+// Postgres keeps throttle state in the login_failures and login_locks tables
+type Postgres struct{}
+
+func NewPostgres() *Postgres {
+	return &Postgres{}
+}
+
+func (p *Postgres) AddFailure(key string, at time.Time) error {
+	return querydb.AddLoginFailure(key, at)
+}
+
+func (p *Postgres) CountFailures(key string, since time.Time) (int, error) {
+	return querydb.CountLoginFailures(key, since)
+}
+
+func (p *Postgres) ClearFailures(key string) error {
+	return querydb.ClearLoginFailures(key)
+}
+
+func (p *Postgres) GetLock(key string) (time.Time, int, error) {
+	return querydb.GetLoginLock(key)
+}
+
+func (p *Postgres) SetLock(key string, until time.Time, strikes int) error {
+	return querydb.SetLoginLock(key, until, strikes)
+}
+
+func (p *Postgres) ClearLock(key string) error {
+	return querydb.ClearLoginLock(key)
+}
+
+func (p *Postgres) Purge(before time.Time) error {
+	return querydb.PurgeLoginThrottle(before)
+}
@@ -0,0 +1,111 @@
+// Package throttle counts failed attempts in a sliding window and locks keys
+// out for an escalating amount of time once they fail too often.
+package throttle
+
+import (
+	"time"
+)
+
+// Store keeps failure timestamps and lockouts. Memory is fine for a single
+// instance, Postgres shares state between instances.
+type Store interface {
+	AddFailure(key string, at time.Time) error
+	CountFailures(key string, since time.Time) (int, error)
+	ClearFailures(key string) error
+	// GetLock returns a zero time when key is not locked
+	GetLock(key string) (time.Time, int, error)
+	SetLock(key string, until time.Time, strikes int) error
+	ClearLock(key string) error
+	// Purge drops failures and expired locks older than before
+	Purge(before time.Time) error
+}
+
+type Limiter struct {
+	store       Store
+	window      time.Duration
+	lockout     time.Duration
+	max_lockout time.Duration
+}
+
+func New(store Store, window time.Duration, lockout time.Duration, max_lockout time.Duration) *Limiter {
+	return &Limiter{store: store, window: window, lockout: lockout, max_lockout: max_lockout}
+}
+
+// Locked returns how long the longest lock among keys has left, 0 if none are locked
+func (l *Limiter) Locked(keys ...string) (time.Duration, error) {
+	var remaining time.Duration
+	now := time.Now().UTC()
+	for _, key := range keys {
+		until, _, err := l.store.GetLock(key)
+		if err != nil {
+			return 0, err
+		}
+		if left := until.Sub(now); left > remaining {
+			remaining = left
+		}
+	}
+	return remaining, nil
+}
+
+// Fail records a failure for key and locks it if it has failed max times within
+// the window. Each lock doubles the previous one up to max_lockout. It returns
+// how many attempts are left before the key is locked.
+func (l *Limiter) Fail(key string, max int) (int, error) {
+	now := time.Now().UTC()
+	if err := l.store.AddFailure(key, now); err != nil {
+		return 0, err
+	}
+	failures, err := l.store.CountFailures(key, now.Add(-l.window))
+	if err != nil {
+		return 0, err
+	}
+	if failures < max {
+		return max - failures, nil
+	}
+
+	_, strikes, err := l.store.GetLock(key)
+	if err != nil {
+		return 0, err
+	}
+	duration := l.lockout
+	for i := 0; i < strikes && duration < l.max_lockout; i++ {
+		duration *= 2
+	}
+	if duration > l.max_lockout {
+		duration = l.max_lockout
+	}
+	if err := l.store.SetLock(key, now.Add(duration), strikes+1); err != nil {
+		return 0, err
+	}
+	return 0, l.store.ClearFailures(key)
+}
+
+// AddFailure records a failure for key without locking it, for callers that
+// enforce their own limit with Failures
+func (l *Limiter) AddFailure(key string) error {
+	return l.store.AddFailure(key, time.Now().UTC())
+}
+
+// Failures counts the failures recorded for key since
+func (l *Limiter) Failures(key string, since time.Time) (int, error) {
+	return l.store.CountFailures(key, since.UTC())
+}
+
+// Succeed forgets every failure and lock for key
+func (l *Limiter) Succeed(key string) error {
+	if err := l.store.ClearFailures(key); err != nil {
+		return err
+	}
+	return l.store.ClearLock(key)
+}
+
+// Purge drops state that can no longer affect a decision. Locks are kept for a
+// day after they expire so repeat offenders keep escalating.
+func (l *Limiter) Purge() error {
+	now := time.Now().UTC()
+	before := now.Add(-l.window)
+	if lockBefore := now.Add(-24 * time.Hour); lockBefore.Before(before) {
+		before = lockBefore
+	}
+	return l.store.Purge(before)
+}
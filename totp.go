@@ -0,0 +1,340 @@
+package main
+
+import (
+	"html/template"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0sm1les/gopherbb/auth"
+	"github.com/0sm1les/gopherbb/models"
+	"github.com/0sm1les/gopherbb/querydb"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// how long a user has to enter their code after the password step
+	pendingLoginTimeout  = 5 * time.Minute
+	pendingLoginMaxTries = 5
+	recoveryCodeCount    = 10
+)
+
+func twoFactorRequired(role string) bool {
+	for _, r := range config.Two_factor.Required_roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func totpIssuer() string {
+	if config.Two_factor.Issuer != "" {
+		return config.Two_factor.Issuer
+	}
+	return "gopherbb"
+}
+
+// completeLogin authenticates the session once every login step has passed
+func completeLogin(userinfo models.User, c *gin.Context) error {
+	if err := authsesssion(userinfo.Id, c); err != nil {
+		return err
+	}
+	loginSucceeded(userinfo.Username)
+	return nil
+}
+
+// startTwoFactor remembers a user that passed the password step and asks for their code
+func startTwoFactor(user_id int32, c *gin.Context) {
+	session, _ := store.Get(c.Request, "session")
+	session.Values["pending_uid"] = user_id
+	session.Values["pending_time"] = time.Now().Unix()
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	renderTwoFactorLogin(c, nil)
+}
+
+func clearPendingLogin(c *gin.Context) {
+	session, _ := store.Get(c.Request, "session")
+	delete(session.Values, "pending_uid")
+	delete(session.Values, "pending_time")
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		logger.Error().Err(err).Msg("")
+	}
+}
+
+// pendingKey is the throttle key counting the code attempts of one pending login
+func pendingKey(user_id int32, started int64) string {
+	return "2fa:" + strconv.Itoa(int(user_id)) + ":" + strconv.FormatInt(started, 10)
+}
+
+func renderTwoFactorLogin(c *gin.Context, inputErrors []string) {
+	html := template.Must(newTemplate().ParseFiles("html/unauth_header.html", "html/totp_login.html", "html/footer.html"))
+	html.ExecuteTemplate(c.Writer, "html/unauth_header.html", gin.H{"Title": "Login", "Registration": config.Registration, "Csrf": csrfToken(c)})
+	html.ExecuteTemplate(c.Writer, "html/totp_login.html", gin.H{"Errors": inputErrors, "Csrf": csrfToken(c)})
+	html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
+}
+
+// loginTwoFactor is the second login step, it accepts a totp code or a recovery code
+func loginTwoFactor(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		index(c)
+		return
+	}
+
+	pending_uid, ok := session.Values["pending_uid"].(int32)
+	pending_time, _ := session.Values["pending_time"].(int64)
+	if !ok || time.Since(time.Unix(pending_time, 0)) > pendingLoginTimeout {
+		clearPendingLogin(c)
+		login(c)
+		return
+	}
+	// counted server side, the cookie can be replayed
+	tries, err := limiter.Failures(pendingKey(pending_uid, pending_time), time.Unix(pending_time, 0))
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	if tries >= pendingLoginMaxTries {
+		clearPendingLogin(c)
+		login(c)
+		return
+	}
+
+	if c.Request.Method == "GET" {
+		renderTwoFactorLogin(c, nil)
+		return
+	}
+
+	pending_user, err := querydb.GetUser(pending_uid)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	locked, err := loginLocked(c, pending_user.Username)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+	}
+	if locked != "" {
+		clearPendingLogin(c)
+		renderTwoFactorLogin(c, []string{locked})
+		return
+	}
+
+	code := c.PostForm("code")
+	valid := false
+
+	secret, enabled, last_step, err := querydb.GetTOTP(pending_uid)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+
+	if step, ok := auth.ValidateTOTP(secret, code, last_step, time.Now()); enabled && ok {
+		valid, err = querydb.UseTOTPStep(pending_uid, step)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+	} else if strings.Contains(code, "-") || len(strings.TrimSpace(code)) == 10 {
+		valid, err = querydb.UseRecoveryCode(pending_uid, auth.HashToken(auth.NormalizeRecoveryCode(code)))
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+	}
+
+	if !valid {
+		if err := limiter.AddFailure(pendingKey(pending_uid, pending_time)); err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		renderTwoFactorLogin(c, []string{loginFailed(c, pending_user.Username, "Incorrect code.")})
+		return
+	}
+
+	userinfo, err := querydb.Userinfo(pending_uid)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	delete(session.Values, "pending_uid")
+	delete(session.Values, "pending_time")
+	if err := limiter.Succeed(pendingKey(pending_uid, pending_time)); err != nil {
+		logger.Error().Err(err).Msg("")
+	}
+	if err := completeLogin(userinfo, c); err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	index(c)
+}
+
+// enrollmentRequired reports whether userinfo's role requires two factor
+// authentication they haven't set up yet
+func enrollmentRequired(userinfo models.User) bool {
+	return twoFactorRequired(userinfo.Role) && !userinfo.Totp_enabled
+}
+
+// twoFactorEnrollment keeps users whose role requires two factor authentication
+// on the settings page until they have enrolled. The role is checked on every
+// request so promotions and disabling two factor are caught too.
+func twoFactorEnrollment(c *gin.Context) {
+	session, _ := store.Get(c.Request, "session")
+	uid, _ := session.Values["id"].(int32)
+	if uid <= 0 {
+		c.Next()
+		return
+	}
+
+	path := c.Request.URL.Path
+	if path == "/user/settings" || strings.HasPrefix(path, "/user/settings/totp") || path == "/logout" ||
+		path == "/gopherbb.css" || path == "/DroidSansMono.ttf" {
+		c.Next()
+		return
+	}
+
+	userinfo, err := querydb.Userinfo(uid)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		c.AbortWithStatus(500)
+		return
+	}
+	if !enrollmentRequired(userinfo) {
+		c.Next()
+		return
+	}
+
+	if _, api := session.Values["api_token"]; api {
+		c.AbortWithStatusJSON(403, gin.H{"error": "enable two factor authentication first"})
+		return
+	}
+
+	if c.GetHeader("HX-Request") != "" {
+		c.Header("HX-Redirect", "/user/settings")
+		c.AbortWithStatus(200)
+		return
+	}
+	c.Redirect(302, "/user/settings")
+	c.Abort()
+}
+
+func totpSetup(uid int32, c *gin.Context) {
+	userinfo, err := querydb.Userinfo(uid)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	if userinfo.Totp_enabled {
+		html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "two factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+
+	session, _ := store.Get(c.Request, "session")
+	session.Values["totp_pending"] = secret
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+
+	html := template.Must(newTemplate().ParseFiles("html/htmx/totp.html"))
+	html.ExecuteTemplate(c.Writer, "html/htmx/totp.html", gin.H{"Secret": secret, "URI": template.URL(auth.TOTPURI(totpIssuer(), string(userinfo.Username), secret))})
+}
+
+func totpConfirm(uid int32, c *gin.Context) {
+	session, _ := store.Get(c.Request, "session")
+	secret, ok := session.Values["totp_pending"].(string)
+	if !ok {
+		html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "start setup again"})
+		return
+	}
+
+	step, valid := auth.ValidateTOTP(secret, c.PostForm("code"), 0, time.Now())
+	if !valid {
+		html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "incorrect code"})
+		return
+	}
+
+	codes, err := auth.NewRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	var hashes []string
+	for _, code := range codes {
+		hashes = append(hashes, auth.HashToken(code))
+	}
+
+	if err := querydb.EnableTOTP(uid, secret, step, hashes); err != nil {
+		logger.Error().Err(err).Msg("")
+		html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "error enabling two factor authentication"})
+		return
+	}
+
+	delete(session.Values, "totp_pending")
+	if err := session.Save(c.Request, c.Writer); err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+
+	c.Header("HX-Retarget", "#totp-section")
+	html := template.Must(newTemplate().ParseFiles("html/htmx/totp.html"))
+	html.ExecuteTemplate(c.Writer, "html/htmx/totp.html", gin.H{"Recovery": codes})
+}
+
+func totpDisable(uid int32, c *gin.Context) {
+	userinfo, err := querydb.Userinfo(uid)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	if twoFactorRequired(userinfo.Role) {
+		html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "your role requires two factor authentication"})
+		return
+	}
+
+	secret, enabled, last_step, err := querydb.GetTOTP(uid)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	step, valid := auth.ValidateTOTP(secret, c.PostForm("code"), last_step, time.Now())
+	if enabled && valid {
+		valid, err = querydb.UseTOTPStep(uid, step)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+	}
+	if !enabled || !valid {
+		html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "incorrect code"})
+		return
+	}
+
+	if err := querydb.DisableTOTP(uid); err != nil {
+		logger.Error().Err(err).Msg("")
+		html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+		html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "error disabling two factor authentication"})
+		return
+	}
+	html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+	html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "ok", "Message": "two factor authentication disabled"})
+}
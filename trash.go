@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"strconv"
+	"time"
+
+	"github.com/0sm1les/gopherbb/models"
+	"github.com/0sm1les/gopherbb/querydb"
+
+	"github.com/gin-gonic/gin"
+)
+
+const modTrashSize = 200
+
+var (
+	trashWindow    time.Duration
+	trashRetention time.Duration
+)
+
+func setupTrash(trash models.TrashConfig) error {
+	var err error
+	if trash.Restore_window != "" {
+		if trashWindow, err = time.ParseDuration(trash.Restore_window); err != nil {
+			return err
+		}
+	}
+	if trash.Retention != "" {
+		if trashRetention, err = time.ParseDuration(trash.Retention); err != nil {
+			return err
+		}
+	}
+	if trash.Purge != "" && trash.Purge != "delete" && trash.Purge != "anonymize" {
+		return fmt.Errorf("unknown purge %q", trash.Purge)
+	}
+	return nil
+}
+
+// purgeDeleted gets rid of content that has been deleted for longer than config.Trash.Retention
+func purgeDeleted() {
+	for range time.Tick(time.Hour) {
+		purged, err := querydb.PurgeDeleted(int64(trashRetention.Seconds()), config.Trash.Purge == "anonymize")
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			continue
+		}
+		if purged > 0 {
+			logger.Info().Int64("purged", purged).Msg("purged deleted posts and comments")
+		}
+	}
+}
+
+// trash lists the user's own deletions they can still restore
+func trash(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		userinfo, err := querydb.Userinfo(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		content, err := querydb.UserTrash(uid, int64(trashWindow.Seconds()))
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		for i := 0; i < len(content); i++ {
+			content[i].Author = models.Userlisted{Username: userinfo.Username, Role: userinfo.Role, User_fg_color: userinfo.User_fg_color, User_bg_color: userinfo.User_bg_color}
+		}
+
+		html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/trash.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "trash", "Userinfo": userinfo, "Csrf": csrfToken(c)})
+		html.ExecuteTemplate(c.Writer, "html/trash.html", gin.H{"Content": content, "Own": true, "Window": config.Trash.Restore_window})
+		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
+	}
+}
+
+// restoreOwn puts back a post or comment from the user's trash
+func restoreOwn(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 32)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		var restored bool
+		switch c.Param("target") {
+		case "post":
+			restored, err = querydb.RestoreOwnPost(int32(id), uid, int64(trashWindow.Seconds()))
+		case "comment":
+			restored, err = querydb.RestoreOwnReply(int32(id), uid, int64(trashWindow.Seconds()))
+		default:
+			return
+		}
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		if !restored {
+			html := template.Must(newTemplate().ParseFiles("html/htmx/form_feedback.html"))
+			html.ExecuteTemplate(c.Writer, "html/htmx/form_feedback.html", gin.H{"Result": "error", "Message": "this can't be restored anymore"})
+			return
+		}
+		c.Header("HX-Refresh", "true")
+	}
+}
+
+// modTrash lists everything that was deleted for staff to restore
+func modTrash(c *gin.Context) {
+	initsession(c)
+	session, _ := store.Get(c.Request, "session")
+	uid := session.Values["id"].(int32)
+	if uid != -1 {
+		userinfo, err := querydb.Userinfo(uid)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		content, err := querydb.DeletedContent(modTrashSize)
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return
+		}
+		for i := 0; i < len(content); i++ {
+			content[i].Author, err = querydb.GetUser(content[i].Poster)
+			if err != nil {
+				logger.Error().Err(err).Msg("")
+				return
+			}
+		}
+
+		html := template.Must(newTemplate().ParseFiles("html/auth_header.html", "html/trash.html", "html/footer.html"))
+		html.ExecuteTemplate(c.Writer, "html/auth_header.html", gin.H{"Title": "deleted content", "Userinfo": userinfo, "Csrf": csrfToken(c)})
+		html.ExecuteTemplate(c.Writer, "html/trash.html", gin.H{"Content": content, "Own": false})
+		html.ExecuteTemplate(c.Writer, "html/footer.html", nil)
+	}
+}